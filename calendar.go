@@ -0,0 +1,160 @@
+package rosarygen
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Seasons lists the liturgical seasons returned by Season, in the order they fall in the church year
+var Seasons = []string{"advent", "christmas", "ordinary", "lent", "eastertide"}
+
+// WeekdayNames lists the days of the week as used in the [weekday] table
+var WeekdayNames = []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+func isSeason(season string) bool {
+	for _, s := range Seasons {
+		if s == season {
+			return true
+		}
+	}
+	return false
+}
+
+func isWeekdayName(day string) bool {
+	for _, d := range WeekdayNames {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// day returns midnight UTC of the given date, so that dates
+// can be compared and counted in whole days
+func day(year int, month time.Month, d int) time.Time {
+	return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+}
+
+func dateOf(t time.Time) time.Time {
+	return day(t.Year(), t.Month(), t.Day())
+}
+
+// ParseDate reads a date given as YYYY-MM-DD, in local time
+func ParseDate(date string) (time.Time, error) {
+	d, err := time.ParseInLocation("2006-01-02", date, time.Local)
+	if err != nil {
+		return d, fmt.Errorf("date '%v': expected YYYY-MM-DD", date)
+	}
+	return d, nil
+}
+
+// Easter returns the date of Easter Sunday in year, by the Gregorian
+// computus (the anonymous algorithm of Meeus, Jones and Butcher)
+func Easter(year int) time.Time {
+	a := year % 19
+	b := year / 100
+	c := year % 100
+	d := b / 4
+	e := b % 4
+	f := (b + 8) / 25
+	g := (b - f + 1) / 3
+	h := (19*a + b - d - g + 15) % 30
+	i := c / 4
+	k := c % 4
+	l := (32 + 2*e + 2*i - h - k) % 7
+	m := (a + 11*h + 22*l) / 451
+	month := (h + l - 7*m + 114) / 31
+	dd := (h+l-7*m+114)%31 + 1
+	return day(year, time.Month(month), dd)
+}
+
+// AdventStart returns the First Sunday of Advent of year,
+// the fourth Sunday before Christmas
+func AdventStart(year int) time.Time {
+	christmas := day(year, time.December, 25)
+	offset := int(christmas.Weekday())
+	if offset == 0 {
+		offset = 7
+	}
+	return christmas.AddDate(0, 0, -offset-21)
+}
+
+// BaptismOfTheLord returns the feast ending the Christmas season that began
+// in the previous year: the Sunday after January 6
+func BaptismOfTheLord(year int) time.Time {
+	epiphany := day(year, time.January, 6)
+	return epiphany.AddDate(0, 0, 7-int(epiphany.Weekday()))
+}
+
+// Season returns the liturgical season of date, one of Seasons:
+// Advent to Christmas Eve, Christmas to the Baptism of the Lord,
+// Lent from Ash Wednesday to Holy Saturday, Eastertide from Easter
+// to Pentecost, and Ordinary Time otherwise
+func Season(date time.Time) string {
+	d := dateOf(date)
+	year := d.Year()
+	easter := Easter(year)
+	switch {
+	case !d.Before(day(year, time.December, 25)):
+		return "christmas"
+	case !d.Before(AdventStart(year)):
+		return "advent"
+	case !d.After(BaptismOfTheLord(year)):
+		return "christmas"
+	case !d.Before(easter.AddDate(0, 0, -46)) && d.Before(easter):
+		return "lent"
+	case !d.Before(easter) && !d.After(easter.AddDate(0, 0, 49)):
+		return "eastertide"
+	default:
+		return "ordinary"
+	}
+}
+
+// Weekdays maps each day of the week to the groups of mysteries said on it,
+// as any value -groups accepts, with Seasons holding the days that differ
+// in particular liturgical seasons
+type Weekdays struct {
+	Days    map[string]string
+	Seasons map[string]map[string]string
+}
+
+func NewWeekdays() *Weekdays {
+	return &Weekdays{
+		Days:    map[string]string{},
+		Seasons: map[string]map[string]string{},
+	}
+}
+
+func (w *Weekdays) SetDay(day string, groups string) {
+	w.Days[day] = groups
+}
+
+func (w *Weekdays) SetSeasonDay(season string, day string, groups string) {
+	if w.Seasons[season] == nil {
+		w.Seasons[season] = map[string]string{}
+	}
+	w.Seasons[season][day] = groups
+}
+
+// GroupsFor returns the groups said on date, or "" if the table does not say
+func (w *Weekdays) GroupsFor(date time.Time) string {
+	name := strings.ToLower(date.Weekday().String())
+	if groups, ok := w.Seasons[Season(date)][name]; ok {
+		return groups
+	}
+	return w.Days[name]
+}
+
+// MergeWeekdays returns a with each day set in b replacing a's
+func MergeWeekdays(a *Weekdays, b *Weekdays) *Weekdays {
+	for k, v := range b.Days {
+		a.SetDay(k, v)
+	}
+	for season, days := range b.Seasons {
+		for k, v := range days {
+			a.SetSeasonDay(season, k, v)
+		}
+	}
+	return a
+}
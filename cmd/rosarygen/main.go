@@ -15,20 +15,86 @@ import (
 )
 
 var (
+	configdirs      = flag.String("configdir", ".", "Comma separated list of folders to search for prayers.toml, structures.toml and options.toml, searched in order given. Built-in defaults are used for any file not found.")
 	idirs           = flag.String("idirs", "data", "Comma separated list of audio data folders, searched in order given")
 	odir            = flag.String("odir", "output", "output folder")
 	ofilename       = flag.String("ofilename", "{{.GroupNum}} {{.Group}} Mysteries", "Output filename template. Available fields: Group, GroupNum, Mystery, MysteryNum, Prayer, PrayerNum, OutputFileNum, XthGroupMystery")
-	mysteryGroups   = flag.String("groups", "All", "Mystery decade groupings to generate. Possible values: All, Old (All excluding Luminous), Joyful, Luminous, Sorrowful, Glorious, and Custom (specify list of mysteries with mysteries)")
-	customMysteries = flag.String("mysteries", "", "List of mysteries to use in place of group. Use ListMysteries to see options.")
+	mysteryGroups   = flag.String("groups", "All", "Mystery decade groupings to generate. Possible values: All, Old (All excluding Luminous) or another set from ListGroupSets, Joyful, Luminous, Sorrowful, Glorious, Today (the mysteries for the day of the week, see -date), and Custom (specify list of mysteries with mysteries, said in order as one group named by customname)")
+	date            = flag.String("date", "", "Date to make the rosary for, as YYYY-MM-DD, choosing the mysteries for -groups Today. Defaults to the current day.")
+	customMysteries = flag.String("mysteries", "", "List of mysteries to use in place of group, by number, name or the start of a name. Use ListMysteries to see options.")
+	customName      = flag.String("customname", "Custom", "Name of the group said for -groups Custom, as used in the output filename and in announcing the mysteries")
 	structure       = flag.String("structure", "basic", "Rosary structure to use. Use ListStructures to see options.")
 	format          = flag.String("format", "wav", "wav or flac")
+	lang            = flag.String("lang", "", "Language of the prayer, mystery and group names and ordinals used in templates, from the [language] table, e.g. es. Its idirs are used unless -idirs is given.")
 	gap             = flag.Int("gapLength", 5, "tenths of seconds of silence to add between prayers")
+	takes           = flag.String("takes", "none", "Look for numbered takes of each file (HailMary_1, HailMary_2, ...) in the audio data folders and choose between them: none, roundrobin, random or shuffle")
+	options         optionFlags
+	sanitize        = flag.String("sanitize", "posix", "Make output filenames safe to write: strict (FAT32 and CD-ROM safe), posix (no / or control characters) or none")
+	seed            = flag.Int64("seed", 1, "Seed for prayers choosing between takes at random. The same seed always chooses the same takes.")
 )
 
+// optionFlags collects each -option given
+type optionFlags []string
+
+func (f *optionFlags) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *optionFlags) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func init() {
+	flag.Var(&options, "option", "Choose an option for a prayer, as prayer=choice, over options.toml. May be given more than once.")
+}
+
 func main() {
 	iniflags.Parse()
 
-	g := rosarygen.NewGenerator()
+	if !rosarygen.IsSanitizePolicy(*sanitize) {
+		log.Fatalf("Unknown -sanitize policy '%v', expected %v", *sanitize, strings.Join(rosarygen.SanitizePolicies, ", "))
+	}
+
+	takePolicy := *takes
+	if takePolicy == "none" {
+		takePolicy = ""
+	} else if !rosarygen.IsTakePolicy(takePolicy) {
+		log.Fatalf("Unknown -takes policy '%v', expected none, %v", takePolicy, strings.Join(rosarygen.TakePolicies, ", "))
+	}
+
+	g, err := rosarygen.NewGenerator(nil, strings.Split(*configdirs, ",")...)
+	if err != nil {
+		log.Fatalf("Errors loading configuration:\n%v", err)
+	}
+	g.CustomName = *customName
+	if *lang != "" {
+		if err := g.SetLanguage(*lang); err != nil {
+			log.Fatal(err)
+		}
+		idirsSet := false
+		flag.Visit(func(f *flag.Flag) {
+			idirsSet = idirsSet || f.Name == "idirs"
+		})
+		if !idirsSet && len(g.Language.InputDirs) > 0 {
+			*idirs = strings.Join(g.Language.InputDirs, ",")
+		}
+	}
+	if *date != "" {
+		g.Date, err = rosarygen.ParseDate(*date)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, o := range options {
+		pair := strings.SplitN(o, "=", 2)
+		if len(pair) < 2 {
+			log.Fatalf("-option %v: expected prayer=choice", o)
+		}
+		if err := g.SetOverride(pair[0], pair[1]); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	if (flag.NArg()) > 0 {
 		switch flag.Arg(0) {
@@ -60,11 +126,41 @@ func main() {
 				fmt.Printf("%v: %v\n", k, g.Groups[k].Name)
 			}
 			return
+		case "ListGroupSets":
+			keys := make([]string, 0, len(g.GroupSets))
+			for k := range g.GroupSets {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				fmt.Printf("%v: %v (%v)\n", k, g.GroupSets[k].Name, strings.Join(g.GroupSets[k].Groups, ", "))
+			}
+			return
 		case "ListMysteries":
-			for i := 1; i <= len(g.Mysteries); i++ {
+			nums := make([]int, 0, len(g.Mysteries))
+			for _, m := range g.Mysteries {
+				if m.Num > 0 {
+					nums = append(nums, m.Num)
+				}
+			}
+			sort.Ints(nums)
+			for _, i := range nums {
 				fmt.Printf("%v: %v\n", i, g.Mysteries[strconv.Itoa(i)].Name)
 			}
 			return
+		case "Validate":
+			errs := g.Validate()
+			if err := rosarygen.CheckTemplate(*ofilename); err != nil {
+				errs = append(errs, fmt.Errorf("ofilename: %v", err))
+			}
+			for _, err := range errs {
+				fmt.Println(err)
+			}
+			if len(errs) > 0 {
+				os.Exit(1)
+			}
+			fmt.Println("No problems found.")
+			return
 		case "ListStructures":
 			keys := make([]string, len(g.Structures), len(g.Structures))
 			i := 0
@@ -96,13 +192,19 @@ func main() {
 			} else {
 				stream = os.Stdin
 			}
-			g.RenderList(stream)
+			g.RenderList(stream, *seed, takePolicy, *sanitize)
 			return
 		}
 
 		// If we get here, they want something from a calculated rosary, so prepare it
-		var r *rosarygen.Rosary
-		r = g.NewRosary(*structure, g.GroupsForRosary(*mysteryGroups, *customMysteries)...)
+		groups, err := g.GroupsForRosary(*mysteryGroups, *customMysteries)
+		if err != nil {
+			log.Fatal(err)
+		}
+		r, err := g.NewRosary(*structure, groups...)
+		if err != nil {
+			log.Fatal(err)
+		}
 		//		switch strings.ToLower(*mysteryGroups) {
 		//		case "all":
 		//			r = g.NewRosary(*structure, "joyful", "luminous", "sorrowful", "glorious")
@@ -117,6 +219,15 @@ func main() {
 			log.Fatal("No Rosary generated.")
 		}
 		inputdirs := strings.Split(*idirs, ",")
+		s := rosarygen.NewStateTracker(inputdirs, *odir, *ofilename, *format)
+		s.SetSeed(*seed)
+		s.TakePolicy = takePolicy
+		s.Date = g.Today()
+		s.Language = g.Language
+		s.Sanitize = *sanitize
+		if err := r.Compile(s, g.Options); err != nil {
+			log.Fatalf("Errors in templates:\n%v", err)
+		}
 		switch flag.Arg(0) {
 		case "Prayers":
 			for _, p := range r.GetPrayers() {
@@ -126,15 +237,20 @@ func main() {
 			onBadFileFunc := func(filename string, err error) {
 				fmt.Printf("%v: %v\n", filename, err)
 			}
-			r.ForEachFile(inputdirs, *odir, *ofilename, *format, g.Options, rosarygen.GetBadFilenamesFunc(onBadFileFunc), nil)
+			r.ForEachFile(inputdirs, *odir, *ofilename, *format, g.Options, rosarygen.GetBadFilenamesFunc(onBadFileFunc), s)
 		case "ActualFiles":
-			r.ForEachFile(inputdirs, *odir, *ofilename, *format, g.Options, rosarygen.PrintActualFilename, nil)
+			r.ForEachFile(inputdirs, *odir, *ofilename, *format, g.Options, rosarygen.PrintActualFilename, s)
 		case "Render":
 			if *format == "flac" {
 				log.Fatal("Not implemented yet.")
 			}
-			r.RenderToFiles(inputdirs, *odir, *ofilename, *format, g.Options, *gap, nil)
+			if err := r.RenderToFiles(inputdirs, *odir, *ofilename, *format, g.Options, *gap, s); err != nil {
+				log.Fatalf("Errors in templates:\n%v", err)
+			}
 
 		}
+		if err := s.Err(); err != nil {
+			log.Fatalf("Errors in templates:\n%v", err)
+		}
 	}
 }
@@ -0,0 +1,51 @@
+package rosarygen
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pelletier/go-toml"
+)
+
+// DefaultConfig holds the prayers.toml and structures.toml shipped with
+// rosarygen. It is used for any config file not found in a config directory.
+//
+//go:embed prayers.toml structures.toml
+var DefaultConfig embed.FS
+
+// LoadConfig searches dirs in order for the named .toml file, falling back
+// to DefaultConfig. Dirs are resolved within fsys, or on the host
+// filesystem if fsys is nil. It returns the parsed file along with the path
+// it was read from.
+func LoadConfig(fsys fs.FS, dirs []string, name string) (*toml.TomlTree, string, error) {
+	for _, dir := range dirs {
+		var p string
+		var data []byte
+		var err error
+		if fsys == nil {
+			p = filepath.Join(dir, name)
+			data, err = os.ReadFile(p)
+		} else {
+			p = path.Join(dir, name)
+			data, err = fs.ReadFile(fsys, p)
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, p, err
+		}
+		tree, err := toml.Load(string(data))
+		return tree, p, err
+	}
+	data, err := fs.ReadFile(DefaultConfig, name)
+	if err != nil {
+		return nil, name, err
+	}
+	tree, err := toml.Load(string(data))
+	return tree, "(default) " + name, err
+}
@@ -0,0 +1,202 @@
+package rosarygen
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+)
+
+// TemplateFuncs are the functions available to every template: output
+// filenames, prayer filenames and conditions. Functions taking a number or a
+// width take it first, so that a value can be piped in, as in
+// {{.Mystery | truncate 8}} or {{.MysteryNum | pad 3 "0"}}.
+//
+//	ordinal, cardinal  English words for a number: 21 gives "Twenty-First", "Twenty-One"
+//	nth                a number with its ordinal suffix: 21 gives "21st"
+//	roman              Roman numerals: 14 gives "XIV"
+//	lower, upper, title  change case; title capitalizes each word
+//	slugify            lowercase words joined by "-": "First Joyful Mystery" gives "first-joyful-mystery"
+//	truncate n s       the first n characters of s
+//	pad n c s          s padded on the left with c to n characters
+//	padright n c s     s padded on the right with c to n characters
+//	add, sub, mul, div, mod  integer arithmetic: {{add .DecadeNum 10}}
+var TemplateFuncs = template.FuncMap{
+	"ordinal":  OrdinalWord,
+	"cardinal": CardinalWord,
+	"nth":      nth,
+	"roman":    Roman,
+	"lower":    strings.ToLower,
+	"upper":    strings.ToUpper,
+	"title":    title,
+	"slugify":  slugify,
+	"truncate": truncate,
+	"pad":      padLeft,
+	"padright": padRight,
+	"add":      func(a int, b int) int { return a + b },
+	"sub":      func(a int, b int) int { return a - b },
+	"mul":      func(a int, b int) int { return a * b },
+	"div":      div,
+	"mod":      mod,
+}
+
+var (
+	smallCardinals = []string{"Zero", "One", "Two", "Three", "Four", "Five", "Six", "Seven", "Eight", "Nine",
+		"Ten", "Eleven", "Twelve", "Thirteen", "Fourteen", "Fifteen", "Sixteen", "Seventeen", "Eighteen", "Nineteen"}
+	tensCardinals    = []string{"", "", "Twenty", "Thirty", "Forty", "Fifty", "Sixty", "Seventy", "Eighty", "Ninety"}
+	irregularOrdinal = map[string]string{"One": "First", "Two": "Second", "Three": "Third", "Five": "Fifth",
+		"Eight": "Eighth", "Nine": "Ninth", "Twelve": "Twelfth"}
+)
+
+// CardinalWord spells out num in English, e.g. "Twenty-One" or "One Hundred Five".
+// Numbers outside 0 to 999 are given as digits.
+func CardinalWord(num int) string {
+	switch {
+	case num < 0 || num > 999:
+		return strconv.Itoa(num)
+	case num < 20:
+		return smallCardinals[num]
+	case num < 100:
+		if num%10 == 0 {
+			return tensCardinals[num/10]
+		}
+		return tensCardinals[num/10] + "-" + smallCardinals[num%10]
+	case num%100 == 0:
+		return smallCardinals[num/100] + " Hundred"
+	default:
+		return smallCardinals[num/100] + " Hundred " + CardinalWord(num%100)
+	}
+}
+
+// OrdinalWord spells out the ordinal of num in English, e.g. "Twenty-First".
+// Numbers outside 1 to 999 are given by nth.
+func OrdinalWord(num int) string {
+	if num < 1 || num > 999 {
+		return nth(num)
+	}
+	words := CardinalWord(num)
+	i := strings.LastIndexAny(words, " -") + 1
+	last := words[i:]
+	switch {
+	case irregularOrdinal[last] != "":
+		last = irregularOrdinal[last]
+	case strings.HasSuffix(last, "y"):
+		last = strings.TrimSuffix(last, "y") + "ieth"
+	default:
+		last += "th"
+	}
+	return words[:i] + last
+}
+
+func nth(num int) string {
+	suffix := "th"
+	switch n := num % 100; {
+	case n < 0:
+	case n >= 11 && n <= 13:
+	case n%10 == 1:
+		suffix = "st"
+	case n%10 == 2:
+		suffix = "nd"
+	case n%10 == 3:
+		suffix = "rd"
+	}
+	return strconv.Itoa(num) + suffix
+}
+
+var romanNumerals = []struct {
+	value  int
+	symbol string
+}{
+	{1000, "M"}, {900, "CM"}, {500, "D"}, {400, "CD"}, {100, "C"}, {90, "XC"},
+	{50, "L"}, {40, "XL"}, {10, "X"}, {9, "IX"}, {5, "V"}, {4, "IV"}, {1, "I"},
+}
+
+// Roman gives num in Roman numerals, e.g. "XIV". Numbers outside 1 to 3999
+// have none, and are given as digits.
+func Roman(num int) string {
+	if num < 1 || num > 3999 {
+		return strconv.Itoa(num)
+	}
+	var b strings.Builder
+	for _, r := range romanNumerals {
+		for num >= r.value {
+			b.WriteString(r.symbol)
+			num -= r.value
+		}
+	}
+	return b.String()
+}
+
+func title(s string) string {
+	start := true
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || r == '-' {
+			start = true
+			return r
+		}
+		if start {
+			start = false
+			return unicode.ToUpper(r)
+		}
+		return r
+	}, s)
+}
+
+func slugify(s string) string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, "-")
+}
+
+func truncate(n int, s string) string {
+	if n < 0 {
+		return ""
+	}
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
+
+func padding(n int, pad string, s string) (string, error) {
+	if utf8.RuneCountInString(pad) != 1 {
+		return "", fmt.Errorf("pad with one character, not %q", pad)
+	}
+	if count := n - utf8.RuneCountInString(s); count > 0 {
+		return strings.Repeat(pad, count), nil
+	}
+	return "", nil
+}
+
+func padLeft(n int, pad string, value interface{}) (string, error) {
+	s := fmt.Sprint(value)
+	p, err := padding(n, pad, s)
+	return p + s, err
+}
+
+func padRight(n int, pad string, value interface{}) (string, error) {
+	s := fmt.Sprint(value)
+	p, err := padding(n, pad, s)
+	return s + p, err
+}
+
+func div(a int, b int) (int, error) {
+	if b == 0 {
+		return 0, errors.New("division by zero")
+	}
+	return a / b, nil
+}
+
+func mod(a int, b int) (int, error) {
+	if b == 0 {
+		return 0, errors.New("division by zero")
+	}
+	return a % b, nil
+}
@@ -2,148 +2,479 @@ package rosarygen
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
-
-	"github.com/pelletier/go-toml"
+	"time"
+	"unicode"
 )
 
 type Generator struct {
+	ConfigFS   fs.FS
+	ConfigDirs []string
+
 	Prayers    map[string]*Prayer
 	Mysteries  map[string]*Mystery
 	Groups     map[string]*Group
+	GroupSets  map[string]*GroupSet
 	Structures map[string]*Structure
+	Blocks     map[string][]Entry
+	Weekdays   *Weekdays
+	Languages  map[string]*Language
 	Options    *Options
+
+	// Language is the language chosen with SetLanguage, or nil for English
+	Language *Language
+
+	// Overrides are used over both Options and a structure's own options,
+	// for options given on the command line. See SetOverride.
+	Overrides *Options
+
+	// Date is the day rosaries are made for, choosing the groups for
+	// "today" from Weekdays. The zero Date means the current day.
+	Date time.Time
+
+	// CustomName names the group made of the mysteries given with
+	// Custom, or "Custom" if it is not set
+	CustomName string
 }
 
 // NewGenerator creates and loads a Generator
-// from .toml files
-func NewGenerator() *Generator {
-	g := &Generator{}
-	g.Init()
-	return g
+// from .toml files found in dirs, searched in order given.
+// Dirs are resolved within fsys, or on the host
+// filesystem if fsys is nil. Any errors found while
+// loading are returned together as an ErrorList.
+func NewGenerator(fsys fs.FS, dirs ...string) (*Generator, error) {
+	g := &Generator{
+		ConfigFS:   fsys,
+		ConfigDirs: dirs,
+	}
+	err := g.Init()
+	return g, err
 }
 
 // Init loads Generator with data from .toml files
 // prayers.toml
 // structures.toml
 // options.toml
-func (g *Generator) Init() {
-	prayerconfig, err := toml.LoadFile("prayers.toml")
+// searching ConfigDirs and falling back to DefaultConfig.
+// It keeps going after a bad entry, so that every problem
+// in every file is reported at once in the returned ErrorList.
+func (g *Generator) Init() error {
+	var errs ErrorList
+
+	g.Prayers = map[string]*Prayer{}
+	g.Mysteries = map[string]*Mystery{}
+	g.Groups = map[string]*Group{}
+	g.GroupSets = map[string]*GroupSet{}
+	g.Structures = map[string]*Structure{}
+	g.Blocks = map[string][]Entry{}
+	g.Weekdays = NewWeekdays()
+	g.Languages = map[string]*Language{}
+	g.Options = NewOptions()
+	g.Overrides = NewOptions()
+
+	prayerconfig, source, err := LoadConfig(g.ConfigFS, g.ConfigDirs, "prayers.toml")
 	if err != nil {
-		fmt.Println("Error reading prayers.toml: ", err.Error())
-		return
+		errs.Add(fmt.Errorf("Error reading %v: %v", source, err))
 	} else {
-		g.Prayers = ParsePrayers(prayerconfig)
-		g.Mysteries = ParseMysteries(prayerconfig)
-		g.Groups = ParseGroups(prayerconfig)
+		g.Prayers, err = ParsePrayers(source, prayerconfig)
+		errs.Add(err)
+		g.Mysteries, err = ParseMysteries(source, prayerconfig)
+		errs.Add(err)
+		g.Groups, err = ParseGroups(source, prayerconfig)
+		errs.Add(err)
+		g.GroupSets, err = ParseGroupSets(source, prayerconfig)
+		errs.Add(err)
+		g.Weekdays, err = ParseWeekdays(source, prayerconfig)
+		errs.Add(err)
+		g.Languages, err = ParseLanguages(source, prayerconfig)
+		errs.Add(err)
 	}
-	structureconfig, err := toml.LoadFile("structures.toml")
+	structureconfig, source, err := LoadConfig(g.ConfigFS, g.ConfigDirs, "structures.toml")
 	if err != nil {
-		fmt.Println("Error reading structures.toml: ", err.Error())
-		return
+		errs.Add(fmt.Errorf("Error reading %v: %v", source, err))
 	} else {
-		g.Structures = ParseStructures(structureconfig)
+		g.Structures, err = ParseStructures(source, structureconfig)
+		errs.Add(err)
+		g.Blocks, err = ParseBlocks(source, structureconfig)
+		errs.Add(err)
 	}
-	optionconfig, err := toml.LoadFile("options.toml")
+	optionconfig, source, err := LoadConfig(g.ConfigFS, g.ConfigDirs, "options.toml")
 	if err != nil {
-		fmt.Println("Error reading options.toml: ", err.Error())
-		g.Options = &Options{}
+		if !errors.Is(err, fs.ErrNotExist) {
+			errs.Add(fmt.Errorf("Error reading %v: %v", source, err))
+		}
 	} else {
-		g.Options = ParseOptions(optionconfig)
+		g.Options, err = ParseOptions(source, optionconfig)
+		errs.Add(err)
 		// now mixin any local redefinitions, extra prayers, etc:
-		g.Prayers = MergePrayers(g.Prayers, ParsePrayers(optionconfig))
-		g.Mysteries = MergeMysteries(g.Mysteries, ParseMysteries(optionconfig))
-		g.Groups = MergeGroups(g.Groups, ParseGroups(optionconfig))
-		g.Structures = MergeStructures(g.Structures, ParseStructures(optionconfig))
+		prayers, err := ParsePrayers(source, optionconfig)
+		errs.Add(err)
+		g.Prayers = MergePrayers(g.Prayers, prayers)
+		mysteries, err := ParseMysteries(source, optionconfig)
+		errs.Add(err)
+		g.Mysteries = MergeMysteries(g.Mysteries, mysteries)
+		groups, err := ParseGroups(source, optionconfig)
+		errs.Add(err)
+		g.Groups = MergeGroups(g.Groups, groups)
+		groupsets, err := ParseGroupSets(source, optionconfig)
+		errs.Add(err)
+		g.GroupSets = MergeGroupSets(g.GroupSets, groupsets)
+		weekdays, err := ParseWeekdays(source, optionconfig)
+		errs.Add(err)
+		g.Weekdays = MergeWeekdays(g.Weekdays, weekdays)
+		languages, err := ParseLanguages(source, optionconfig)
+		errs.Add(err)
+		g.Languages = MergeLanguages(g.Languages, languages)
+		structures, err := ParseStructures(source, optionconfig)
+		errs.Add(err)
+		g.Structures = MergeStructures(g.Structures, structures)
+		blocks, err := ParseBlocks(source, optionconfig)
+		errs.Add(err)
+		g.Blocks = MergeBlocks(g.Blocks, blocks)
 	}
+	if _, ok := g.Prayers[VerseMeditation]; !ok {
+		g.Prayers[VerseMeditation] = NewVerseMeditation()
+	}
+	errs.Add(ResolveStructures(g.Structures, g.Blocks))
+	errs.Add(g.Options.Check("options", g.Prayers))
+	for _, k := range sortedKeys(g.Structures) {
+		errs.Add(g.Structures[k].Options.Check("structure '"+k+"' options", g.Prayers))
+	}
+	return errs.Err()
+}
 
+// SetOverride chooses choice for prayer over any option loaded from
+// the configuration, or removes the override if choice is "".
+func (g *Generator) SetOverride(prayer string, choice string) error {
+	return setOverride(g.Overrides, g.Prayers, prayer, choice)
 }
 
+func setOverride(overrides *Options, prayers map[string]*Prayer, prayer string, choice string) error {
+	if _, ok := prayers[prayer]; !ok {
+		return fmt.Errorf("option %v=%v: unknown prayer '%v'", prayer, choice, prayer)
+	}
+	if choice == "" {
+		delete(overrides.Options, prayer)
+		return nil
+	}
+	o := NewOptions()
+	o.AddOption(prayer, choice)
+	if err := o.Check("option "+prayer+"="+choice, prayers); err != nil {
+		return err
+	}
+	overrides.AddOption(prayer, choice)
+	return nil
+}
+
+// FindMystery returns the mystery named by mystery, or nil if there is
+// no such mystery or more than one (see LookupMystery)
 func (g *Generator) FindMystery(mystery string) *Mystery {
-	for _, k := range g.Mysteries {
-		if strings.ToLower(k.Name) == mystery {
-			return k
+	m, _ := g.LookupMystery(mystery)
+	return m
+}
+
+// LookupMystery returns the mystery given by its number, by its name or
+// desc ignoring case and spaces, or by the start of only one name or desc,
+// so "6", "agony in the garden" and "agon" all give the Agony. If there
+// is no such mystery the error suggests the closest.
+func (g *Generator) LookupMystery(mystery string) (*Mystery, error) {
+	if n, err := strconv.Atoi(strings.TrimSpace(mystery)); err == nil {
+		// mystery 0 stands in for the preamble and postamble, and is not one to say
+		if m, ok := g.Mysteries[strconv.Itoa(n)]; ok && n > 0 {
+			return m, nil
 		}
+		return nil, fmt.Errorf("no mystery %v, use ListMysteries to see them", n)
 	}
-	return nil
+	want := normalizeName(mystery)
+	if want == "" {
+		return nil, fmt.Errorf("no mystery given")
+	}
+	ms := g.sortedMysteries()
+	var prefixed, near []*Mystery
+	for _, m := range ms {
+		if m.Num < 1 {
+			continue
+		}
+		prefix, dist := false, len(want)
+		for _, name := range []string{m.Name, m.Desc} {
+			name = normalizeName(name)
+			if name == "" {
+				continue
+			}
+			if name == want {
+				return m, nil
+			}
+			prefix = prefix || strings.HasPrefix(name, want)
+			if d := editDistance(want, name); d < dist {
+				dist = d
+			}
+		}
+		if prefix {
+			prefixed = append(prefixed, m)
+		}
+		if dist <= len(want)/3+1 {
+			near = append(near, m)
+		}
+	}
+	switch {
+	case len(prefixed) == 1:
+		return prefixed[0], nil
+	case len(prefixed) > 1:
+		return nil, fmt.Errorf("mystery '%v' could be any of %v", mystery, describeMysteries(prefixed))
+	case len(near) > 0:
+		return nil, fmt.Errorf("no mystery '%v', did you mean %v?", mystery, describeMysteries(near))
+	default:
+		return nil, fmt.Errorf("no mystery '%v', use ListMysteries to see them", mystery)
+	}
+}
+
+// sortedMysteries returns the mysteries in order of Num
+func (g *Generator) sortedMysteries() []*Mystery {
+	ms := make([]*Mystery, 0, len(g.Mysteries))
+	for _, m := range g.Mysteries {
+		ms = append(ms, m)
+	}
+	sort.Slice(ms, func(i, j int) bool {
+		return ms[i].Num < ms[j].Num
+	})
+	return ms
+}
+
+func describeMysteries(ms []*Mystery) string {
+	r := make([]string, len(ms))
+	for i, m := range ms {
+		r[i] = fmt.Sprintf("%v (%v)", m.Name, m.Num)
+	}
+	return strings.Join(r, ", ")
+}
+
+// normalizeName lowercases name and drops everything but letters and digits
+func normalizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, name)
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cur[j] = prev[j-1]
+			if ra[i-1] != rb[j-1] {
+				cur[j]++
+			}
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// Today returns Date, or the current day if Date is not set
+func (g *Generator) Today() time.Time {
+	if g.Date.IsZero() {
+		return time.Now()
+	}
+	return g.Date
+}
+
+// GroupsForRosary returns the keys of the groups named by groups, which may be a
+// single group, one of GroupSets (All, Old) in order of Group.Order, Custom for
+// the list of mysteries, or Today for the groups the Weekdays table gives for Today().
+// It fails if the Weekdays table sets no groups for the day.
+func (g *Generator) GroupsForRosary(groups string, mysteries string) ([]string, error) {
+	return g.groupsForRosary(groups, mysteries, g.Today())
 }
 
-func (g *Generator) GroupsForRosary(groups string, mysteries string) []string {
-	switch strings.ToLower(groups) {
-	case "all":
-		return []string{"joyful", "luminous", "sorrowful", "glorious"}
-	case "old":
-		return []string{"joyful", "sorrowful", "glorious"}
+func (g *Generator) groupsForRosary(groups string, mysteries string, date time.Time) ([]string, error) {
+	key := strings.ToLower(groups)
+	if set, ok := g.GroupSets[key]; ok {
+		return g.sortGroups(set.Groups), nil
+	}
+	switch key {
+	case "today":
+		day := g.Weekdays.GroupsFor(date)
+		if day == "" {
+			return nil, fmt.Errorf("no groups set for %v in [weekday]", strings.ToLower(date.Weekday().String()))
+		}
+		return g.groupsForRosary(day, mysteries, date)
 	case "custom":
-		return strings.Split(strings.ToLower(mysteries), ",")
+		r := strings.Split(strings.ToLower(mysteries), ",")
+		for i := range r {
+			r[i] = strings.TrimSpace(r[i])
+		}
+		return r, nil
 	default:
-		return []string{strings.ToLower(groups)}
+		return []string{key}, nil
+	}
+}
+
+// sortGroups returns keys in order of Group.Order, keeping the order
+// given between groups of the same Order. Unknown groups go last.
+func (g *Generator) sortGroups(keys []string) []string {
+	r := append([]string{}, keys...)
+	order := func(k string) int {
+		if group, ok := g.Groups[k]; ok {
+			return group.Order
+		}
+		return math.MaxInt
+	}
+	sort.SliceStable(r, func(i, j int) bool {
+		return order(r[i]) < order(r[j])
+	})
+	return r
+}
+
+// NewRosary expands structure, which may also be a prayer key or a [list,of,prayers],
+// for groups, with Overrides used over the structure's options. Mysteries given
+// in place of groups are said together as one group, named CustomName. It fails
+// if the structure or one of the groups or mysteries is not known.
+func (g *Generator) NewRosary(structure string, groups ...string) (*Rosary, error) {
+	r, err := g.newRosary(structure, g.CustomName, groups...)
+	if err != nil {
+		return nil, err
 	}
+	r.Override(g.Overrides)
+	return r, nil
 }
 
-func (g *Generator) NewRosary(structure string, groups ...string) *Rosary {
+func (g *Generator) newRosary(structure string, customName string, groups ...string) (*Rosary, error) {
+	var st *Structure
+	if found, ok := g.Structures[structure]; ok {
+		st = found
+	} else if _, ok := g.Prayers[structure]; ok {
+		// So, it's a prayer. One lonely single prayer. Let's mock up a structure and run with it.
+		st = StructureForPrayer(structure)
+	} else if strings.Contains(structure, "[") {
+		// Getting silly now - we are trying to define a structure on the fly? Oh well, handle it if we can.
+		structure = strings.Replace(structure, "[", "", -1)
+		structure = strings.Replace(structure, "]", "", -1)
+		structure = strings.Replace(structure, "\"", "", -1)
+		st = StructureForPrayers(structure)
+		if err := st.expand(g.Blocks); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("structure %s not found", structure)
+	}
+	if !st.SaysGroups() {
+		// groups are not said, so lists naming the groups once used
+		// for chaplets, such as chapletofdivinemercy,five, still work
+		groups = nil
+	}
+	groupList, err := g.lookupGroups(customName, groups)
+	if err != nil {
+		return nil, err
+	}
+	return NewRosary(st, groupList, g.Mysteries, g.Prayers), nil
+}
+
+// lookupGroups returns the groups named by groups, with consecutive
+// mysteries gathered into one custom group named customName
+func (g *Generator) lookupGroups(customName string, groups []string) ([]*Group, error) {
+	if customName == "" {
+		customName = "Custom"
+	}
 	actualGroups := []*Group{}
+	var custom *Group
 	for _, v := range groups {
 		group, ok := g.Groups[v]
 		if ok {
 			actualGroups = append(actualGroups, group)
+			custom = nil
 		} else {
-			mystery := g.FindMystery(v)
-			if mystery != nil {
-				newgroup := NewGroup(-1, "Custom", "Custom")
-				newgroup.AddMystery(mystery.Num)
-				actualGroups = append(actualGroups, newgroup)
+			mystery, err := g.LookupMystery(v)
+			if err != nil {
+				if _, nerr := strconv.Atoi(strings.TrimSpace(v)); nerr != nil {
+					// a name, given as a group as likely as a mystery
+					return nil, fmt.Errorf("unknown group or mystery '%v': %v", v, err)
+				}
+				return nil, err
 			}
-		}
-	}
-	_, ok := g.Structures[structure]
-	if !ok {
-		_, ok := g.Prayers[structure]
-		if !ok {
-			if strings.Contains(structure, "[") {
-				// Getting silly now - we are trying to define a structure on the fly? Oh well, handle it if we can.
-				structure = strings.Replace(structure, "[", "", -1)
-				structure = strings.Replace(structure, "]", "", -1)
-				structure = strings.Replace(structure, "\"", "", -1)
-				return NewRosary(StructureForPrayers(structure), actualGroups, g.Mysteries, g.Prayers)
-			} else {
-				log.Fatalf("Structure %s not found.\n", structure)
+			if custom == nil {
+				custom = NewGroup(-1, "custom", customName)
+				actualGroups = append(actualGroups, custom)
 			}
+			custom.AddMystery(mystery.Num)
 		}
-		// So, it's a prayer. One lonely single prayer. Let's mock up a structure and run with it.
-		return NewRosary(StructureForPrayer(structure), actualGroups, g.Mysteries, g.Prayers)
-
 	}
-	return NewRosary(g.Structures[structure], actualGroups, g.Mysteries, g.Prayers)
+	return actualGroups, nil
 }
 
-func (g *Generator) RenderList(reader io.Reader) {
+// RenderList renders each structure in the list read from reader, choosing
+// takes starting from seed unless the list sets its own, looking for
+// numbered takes by takePolicy (see StateTracker.TakePolicy), and making
+// output filenames safe by sanitize (see SanitizePolicies). The whole list
+// is read, and every structure in it built and compiled, before any is
+// rendered, so that a mistake late in the list stops it before anything
+// is written.
+func (g *Generator) RenderList(reader io.Reader, seed int64, takePolicy string, sanitize string) {
 	var params map[string]string
 	var s *StateTracker
 	var pieces []string
 	var pair []string
 
+	// steps change s between renders, and render, in the order of the list
+	var steps []func() error
+	var errs ErrorList
+
 	params = map[string]string{
-		"idirs":     "data",
-		"odir":      "output",
-		"ofilename": "{{.GroupNum}} {{.Group}} Mysteries",
-		"groups":    "All",
-		"mysteries": "",
-		"structure": "basic",
-		"format":    "wav",
-		"gap":       "5",
+		"idirs":      "data",
+		"odir":       "output",
+		"ofilename":  "{{.GroupNum}} {{.Group}} Mysteries",
+		"groups":     "All",
+		"mysteries":  "",
+		"customname": "Custom",
+		"structure":  "basic",
+		"format":     "wav",
+		"gap":        "5",
 	}
 
+	// option.prayer=choice parameters last for the rest of the list
+	overrides := NewOptions()
+
+	if g.Language != nil && len(g.Language.InputDirs) > 0 {
+		params["idirs"] = strings.Join(g.Language.InputDirs, ",")
+	}
+
+	date := g.Today()
+
 	s = NewStateTracker(nil, "", "", "")
+	s.Date = date
+	s.Language = g.Language
+	s.SetSeed(seed)
+	s.TakePolicy = takePolicy
+	s.Sanitize = sanitize
 
 	render := false
+	lineNum := 0
 	scanner := bufio.NewScanner(reader)
 	for scanner.Scan() {
 		line := scanner.Text()
+		lineNum++
 		if strings.HasPrefix(line, "#") {
 			continue
 		}
@@ -154,7 +485,11 @@ func (g *Generator) RenderList(reader io.Reader) {
 			for _, piece := range pieces {
 				piece = strings.Replace(piece, "|", " ", -1)
 				pair = strings.SplitN(piece, "=", 2)
-				if len(pair) > 1 {
+				if len(pair) > 1 && strings.HasPrefix(pair[0], "option.") {
+					if err := setOverride(overrides, g.Prayers, strings.TrimPrefix(pair[0], "option."), pair[1]); err != nil {
+						log.Fatal(err)
+					}
+				} else if len(pair) > 1 {
 					params[pair[0]] = pair[1]
 					if pair[0] == "structure" {
 						// we set the structure, so render it
@@ -164,7 +499,51 @@ func (g *Generator) RenderList(reader io.Reader) {
 						// resetting the filenumber
 						fnum, err := strconv.Atoi(pair[1])
 						if err == nil {
-							s.OutputFileNum = fnum - 1
+							steps = append(steps, func() error {
+								s.OutputFileNum = fnum - 1
+								return nil
+							})
+						}
+					} else if pair[0] == "takes" {
+						policy := pair[1]
+						switch {
+						case policy == "none":
+							policy = ""
+						case !IsTakePolicy(policy):
+							log.Fatalf("takes=%v: expected none, %v", pair[1], strings.Join(TakePolicies, ", "))
+						}
+						steps = append(steps, func() error {
+							s.TakePolicy = policy
+							return nil
+						})
+					} else if pair[0] == "sanitize" {
+						policy := pair[1]
+						if !IsSanitizePolicy(policy) {
+							log.Fatalf("sanitize=%v: expected one of %v", policy, strings.Join(SanitizePolicies, ", "))
+						}
+						steps = append(steps, func() error {
+							s.Sanitize = policy
+							return nil
+						})
+					} else if pair[0] == "date" {
+						// the day for groups=today and for conditions
+						d, err := ParseDate(pair[1])
+						if err != nil {
+							log.Fatal(err)
+						}
+						date = d
+						steps = append(steps, func() error {
+							s.Date = d
+							return nil
+						})
+					} else if pair[0] == "seed" {
+						// restarting the choice of takes
+						n, err := strconv.ParseInt(pair[1], 10, 64)
+						if err == nil {
+							steps = append(steps, func() error {
+								s.SetSeed(n)
+								return nil
+							})
 						}
 					}
 				} else if strings.ToLower(pair[0]) == "render" {
@@ -188,23 +567,53 @@ func (g *Generator) RenderList(reader io.Reader) {
 		}
 		if render {
 			inputdirs := strings.Split(params["idirs"], ",")
-
-			s.InputDirs = inputdirs
-			s.OutputDir = params["odir"]
-			s.OutputFilenameTemplate = params["ofilename"]
-			s.Format = params["format"]
-			s.GroupNum = 0
-			s.MysteryNum = 0
-			r := g.NewRosary(params["structure"], g.GroupsForRosary(params["groups"], params["mysteries"])...)
+			odir := params["odir"]
+			ofilename := params["ofilename"]
+			format := params["format"]
 			gap, err := strconv.Atoi(params["gap"])
 			if err != nil {
 				gap = 5
 			}
-			// By preparing and sending s here
-			// OutputFileNums will increment across the entire list of renders
-			r.RenderToFiles(inputdirs, params["odir"], params["ofilename"], params["format"], g.Options, gap, s)
-
+			groups, err := g.groupsForRosary(params["groups"], params["mysteries"], date)
+			if err != nil {
+				errs.Add(fmt.Errorf("line %v: %v", lineNum, err))
+				render = false
+				continue
+			}
+			r, err := g.newRosary(params["structure"], params["customname"], groups...)
+			if err != nil {
+				errs.Add(fmt.Errorf("line %v: %v", lineNum, err))
+				render = false
+				continue
+			}
+			r.Override(g.Overrides)
+			r.Override(overrides)
+			s.OutputFilenameTemplate = ofilename
+			if err := r.Compile(s, g.Options); err != nil {
+				errs.Add(fmt.Errorf("line %v: %v", lineNum, err))
+			}
+			steps = append(steps, func() error {
+				s.InputDirs = inputdirs
+				s.OutputDir = odir
+				s.OutputFilenameTemplate = ofilename
+				s.Format = format
+				// entering the preamble counts it, and a list has always
+				// numbered the preamble 0 and the first group 1
+				s.GroupNum = -1
+				s.MysteryNum = 0
+				// By preparing and sending s here
+				// OutputFileNums will increment across the entire list of renders
+				return r.RenderToFiles(inputdirs, odir, ofilename, format, g.Options, gap, s)
+			})
 		}
 		render = false
 	}
+	if err := errs.Err(); err != nil {
+		log.Fatalf("Errors in list:\n%v", err)
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			log.Fatalf("Errors in templates:\n%v", err)
+		}
+	}
 }
@@ -0,0 +1,145 @@
+package rosarygen
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Language holds the words a language needs beyond the names of prayers,
+// mysteries and groups, from a [language] table. Fields left empty fall back
+// to English.
+type Language struct {
+	Key  string
+	Name string
+
+	// Ordinals are the words of NumWord ("First", "Second", ...),
+	// and Counts those of CountWord ("One", "Two", ...)
+	Ordinals []string
+	Counts   []string
+
+	// StandaloneOrdinals are the ordinals used with no noun after them,
+	// where the language shortens Ordinals before one ("Primero" for
+	// "Primer"), for StandaloneNumWord. Left empty, Ordinals are used.
+	StandaloneOrdinals []string
+
+	// XthGroupMystery and XofGroup are templates for the StateTracker
+	// functions of the same names, for languages ordering the words differently
+	XthGroupMystery string
+	XofGroup        string
+
+	// Preamble and Postamble name the prayers before the first group
+	// and after the last, in place of those functions
+	Preamble  string
+	Postamble string
+
+	// InputDirs are searched for audio files in place of -idirs,
+	// so that each language can have its own recordings
+	InputDirs []string
+}
+
+func NewLanguage(key string, name string) *Language {
+	return &Language{
+		Key:  key,
+		Name: name,
+	}
+}
+
+// Ordinal returns the ordinal word for num, and false if the language has none
+func (l *Language) Ordinal(num int) (string, bool) {
+	return wordFor(l.Ordinals, num)
+}
+
+// StandaloneOrdinal returns the ordinal word for num used with no noun
+// after it, and false if the language has none
+func (l *Language) StandaloneOrdinal(num int) (string, bool) {
+	if len(l.StandaloneOrdinals) == 0 {
+		return l.Ordinal(num)
+	}
+	return wordFor(l.StandaloneOrdinals, num)
+}
+
+// Count returns the cardinal word for num, and false if the language has none
+func (l *Language) Count(num int) (string, bool) {
+	return wordFor(l.Counts, num)
+}
+
+// Section returns the language's word for the "Preamble" or "Postamble"
+// group, and false if it has none
+func (l *Language) Section(group string) (string, bool) {
+	word := ""
+	switch group {
+	case "Preamble":
+		word = l.Preamble
+	case "Postamble":
+		word = l.Postamble
+	}
+	return word, word != ""
+}
+
+func wordFor(words []string, num int) (string, bool) {
+	if num < 1 || num > len(words) {
+		return "", false
+	}
+	return words[num-1], true
+}
+
+// Localized holds the translations of a prayer, mystery or group,
+// by language key and then field name, from its [lang] subtables
+type Localized map[string]map[string]string
+
+func (l Localized) Set(lang string, field string, value string) {
+	if l[lang] == nil {
+		l[lang] = map[string]string{}
+	}
+	l[lang][field] = value
+}
+
+// localize sets *value to the translation of field into lang, if there is one
+func (l Localized) localize(lang string, field string, value *string) {
+	if x, ok := l[lang][field]; ok {
+		*value = x
+	}
+}
+
+// MergeLanguages returns a with each language in b replacing a's
+func MergeLanguages(a map[string]*Language, b map[string]*Language) map[string]*Language {
+	for k, v := range b {
+		a[k] = v
+	}
+	return a
+}
+
+// SetLanguage translates the names, texts and descriptions of the loaded
+// prayers, mysteries and groups into lang, which must be in Languages, and
+// uses its words for ordinals. Names used in filename templates, such as
+// {{.Mystery}}, are translated too, so the language's recordings should be
+// named to match. It should be called once, after loading.
+func (g *Generator) SetLanguage(lang string) error {
+	l, ok := g.Languages[strings.ToLower(lang)]
+	if !ok {
+		return fmt.Errorf("unknown language '%v', choose one of %v", lang, strings.Join(sortedKeys(g.Languages), ", "))
+	}
+	g.Language = l
+	for _, p := range g.Prayers {
+		p.localize(l.Key)
+	}
+	for _, m := range g.Mysteries {
+		m.Lang.localize(l.Key, "name", &m.Name)
+		m.Lang.localize(l.Key, "desc", &m.Desc)
+		m.Lang.localize(l.Key, "fruit", &m.Fruit)
+		m.Lang.localize(l.Key, "meditation", &m.Meditation)
+	}
+	for _, gr := range g.Groups {
+		gr.Lang.localize(l.Key, "name", &gr.Name)
+	}
+	return nil
+}
+
+func (p *Prayer) localize(lang string) {
+	p.Lang.localize(lang, "name", &p.Name)
+	p.Lang.localize(lang, "text", &p.Text)
+	p.Lang.localize(lang, "desc", &p.Desc)
+	for _, po := range p.Options {
+		po.localize(lang)
+	}
+}
@@ -1,28 +1,140 @@
 package rosarygen
 
+import "fmt"
+
+// OptionProvider chooses which of a prayer's options to say, by the option's
+// index ("4") or key ("flameoflove"), or "" for its first option (see Prayer.Option).
+// The StateTracker describes where in the rosary the prayer is being said,
+// and may be nil when there is no such context.
 type OptionProvider interface {
-	GetOption(prayer string) int
+	GetOption(prayer string, s *StateTracker) string
 }
 
 type Options struct {
-	Options map[string]int
+	Options map[string]string
+	Rules   map[string][]*OptionRule
+}
+
+// OptionRule chooses Option for a prayer wherever When is true (see StateTracker.Test)
+type OptionRule struct {
+	When   string
+	Option string
 }
 
 func NewOptions() *Options {
 	return &Options{
-		Options: make(map[string]int, 10),
+		Options: make(map[string]string, 10),
+		Rules:   make(map[string][]*OptionRule),
 	}
 }
 
-func (o *Options) AddOption(prayer string, choice int) {
+func (o *Options) AddOption(prayer string, choice string) {
 	o.Options[prayer] = choice
 }
 
-func (o *Options) GetOption(prayer string) int {
+// AddRule adds a rule for prayer, checked after any rules already added
+func (o *Options) AddRule(prayer string, when string, choice string) {
+	o.Rules[prayer] = append(o.Rules[prayer], &OptionRule{When: when, Option: choice})
+}
+
+// Prayers returns the keys of every prayer with an option or rules set, in sorted order
+func (o *Options) Prayers() []string {
+	set := make(map[string]bool, len(o.Options)+len(o.Rules))
+	for k := range o.Options {
+		set[k] = true
+	}
+	for k := range o.Rules {
+		set[k] = true
+	}
+	return sortedKeys(set)
+}
+
+// Merge sets every prayer set in b as b sets it, replacing
+// both the option and the rules o had for that prayer
+func (o *Options) Merge(b *Options) {
+	for _, k := range b.Prayers() {
+		delete(o.Options, k)
+		delete(o.Rules, k)
+		if x, ok := b.Options[k]; ok {
+			o.Options[k] = x
+		}
+		if rules, ok := b.Rules[k]; ok {
+			o.Rules[k] = append([]*OptionRule{}, rules...)
+		}
+	}
+}
+
+// Lookup returns the choice for prayer from the first of its rules
+// that is true for s, or else its option, and whether one was found.
+// Rules are skipped if s is nil.
+func (o *Options) Lookup(prayer string, s *StateTracker) (string, bool) {
+	if s != nil {
+		for _, r := range o.Rules[prayer] {
+			if s.Test(r.When) {
+				return r.Option, true
+			}
+		}
+	}
 	x, ok := o.Options[prayer]
-	if ok {
+	return x, ok
+}
+
+func (o *Options) GetOption(prayer string, s *StateTracker) string {
+	x, _ := o.Lookup(prayer, s)
+	return x
+}
+
+// Check reports every choice, including those made by rules, naming an option
+// its prayer does not have. Choices for prayers not in prayers are left
+// for Generator.Validate to report.
+func (o *Options) Check(where string, prayers map[string]*Prayer) error {
+	var errs ErrorList
+	for _, k := range o.Prayers() {
+		p, ok := prayers[k]
+		if !ok {
+			continue
+		}
+		choices := []string{}
+		if choice, ok := o.Options[k]; ok {
+			choices = append(choices, choice)
+		}
+		for _, r := range o.Rules[k] {
+			choices = append(choices, r.Option)
+		}
+		for _, choice := range choices {
+			switch _, ok := p.Option(choice); {
+			case ok:
+			case len(p.Options) == 0 && (choice == "" || choice == "1"):
+			case len(p.Options) == 0:
+				errs.Add(fmt.Errorf("%v: prayer '%v' has no options, but option '%v' is chosen", where, k, choice))
+			default:
+				errs.Add(fmt.Errorf("%v: prayer '%v' has no option '%v', choose one of %v", where, k, choice, p.DescribeOptions()))
+			}
+		}
+	}
+	return errs.Err()
+}
+
+// LayeredOptions chooses from Options for the prayers it sets,
+// and from Base (or the first option if Base is nil) for any other prayer
+type LayeredOptions struct {
+	Options *Options
+	Base    OptionProvider
+}
+
+func NewLayeredOptions(options *Options, base OptionProvider) *LayeredOptions {
+	return &LayeredOptions{
+		Options: options,
+		Base:    base,
+	}
+}
+
+func (l *LayeredOptions) GetOption(prayer string, s *StateTracker) string {
+	if x, ok := l.Options.Lookup(prayer, s); ok {
 		return x
-	} else {
-		return 1
 	}
+	if l.Base == nil {
+		return ""
+	}
+	return l.Base.GetOption(prayer, s)
 }
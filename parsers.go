@@ -1,158 +1,801 @@
 package rosarygen
 
 import (
-	"log"
+	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/pelletier/go-toml"
 )
 
-func ParsePrayers(data *toml.TomlTree) map[string]*Prayer {
+// ParseError reports a problem with one field of a table in a .toml config file
+type ParseError struct {
+	File  string
+	Line  int
+	Key   string // table key, e.g. prayer.hailmary
+	Field string
+	Msg   string
+}
+
+func (e *ParseError) Error() string {
+	where := e.File
+	if e.Line > 0 {
+		where = fmt.Sprintf("%v:%v", e.File, e.Line)
+	}
+	if e.Field == "" {
+		return fmt.Sprintf("%v: [%v] %v", where, e.Key, e.Msg)
+	}
+	return fmt.Sprintf("%v: [%v] %v: %v", where, e.Key, e.Field, e.Msg)
+}
+
+// ErrorList collects errors so they can all be reported at once
+type ErrorList []error
+
+func (l ErrorList) Error() string {
+	s := make([]string, len(l))
+	for i, err := range l {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+// Add appends err, flattening it if it is itself an ErrorList
+func (l *ErrorList) Add(err error) {
+	if err == nil {
+		return
+	}
+	if el, ok := err.(ErrorList); ok {
+		*l = append(*l, el...)
+	} else {
+		*l = append(*l, err)
+	}
+}
+
+// Err returns nil for an empty list, so callers can return it as an error
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// tomlTable wraps one table of a .toml config file with typed accessors
+// that record a ParseError naming the file, table and field on failure
+type tomlTable struct {
+	file string
+	key  string
+	tree *toml.TomlTree
+	errs *ErrorList
+}
+
+func newTomlTable(file string, key string, tree *toml.TomlTree, errs *ErrorList) *tomlTable {
+	return &tomlTable{
+		file: file,
+		key:  key,
+		tree: tree,
+		errs: errs,
+	}
+}
+
+func (t *tomlTable) fail(field string, format string, args ...interface{}) {
+	line := t.tree.GetPosition("").Line
+	if field != "" && t.tree.Has(field) {
+		line = t.tree.GetPosition(field).Line
+	}
+	t.errs.Add(&ParseError{
+		File:  t.file,
+		Line:  line,
+		Key:   t.key,
+		Field: field,
+		Msg:   fmt.Sprintf(format, args...),
+	})
+}
+
+func (t *tomlTable) Has(field string) bool {
+	return t.tree.Has(field)
+}
+
+// Keys returns the keys of the table in sorted order
+func (t *tomlTable) Keys() []string {
+	keys := t.tree.Keys()
+	sort.Strings(keys)
+	return keys
+}
+
+func (t *tomlTable) String(field string, required bool) string {
+	if !t.tree.Has(field) {
+		if required {
+			t.fail(field, "missing required field")
+		}
+		return ""
+	}
+	v, ok := t.tree.Get(field).(string)
+	if !ok {
+		t.fail(field, "expected a string, found %v", describeValue(t.tree.Get(field)))
+	}
+	return v
+}
+
+func (t *tomlTable) Int(field string, required bool) int {
+	if !t.tree.Has(field) {
+		if required {
+			t.fail(field, "missing required field")
+		}
+		return 0
+	}
+	v, ok := t.tree.Get(field).(int64)
+	if !ok {
+		t.fail(field, "expected an integer, found %v", describeValue(t.tree.Get(field)))
+	}
+	return int(v)
+}
+
+func (t *tomlTable) Strings(field string, required bool) []string {
+	r := []string{}
+	if !t.tree.Has(field) {
+		if required {
+			t.fail(field, "missing required field")
+		}
+		return r
+	}
+	list, ok := t.tree.Get(field).([]interface{})
+	if !ok {
+		t.fail(field, "expected a list of strings, found %v", describeValue(t.tree.Get(field)))
+		return r
+	}
+	for i, v := range list {
+		s, ok := v.(string)
+		if !ok {
+			t.fail(field, "entry %v: expected a string, found %v", i+1, describeValue(v))
+			continue
+		}
+		r = append(r, s)
+	}
+	return r
+}
+
+// Choice reads an option choice, given as either an index or a key
+func (t *tomlTable) Choice(field string, required bool) string {
+	if n, ok := t.tree.Get(field).(int64); ok {
+		return strconv.FormatInt(n, 10)
+	}
+	if _, ok := t.tree.Get(field).(string); !ok && t.tree.Has(field) {
+		t.fail(field, "expected an option number or name, found %v", describeValue(t.tree.Get(field)))
+		return ""
+	}
+	return t.String(field, required)
+}
+
+// Entries reads a list of prayers, given either as prayer keys or as
+// { prayer = "key", when = "template" } tables, since a TOML list
+// cannot mix the two
+func (t *tomlTable) Entries(field string, required bool) []Entry {
+	r := []Entry{}
+	if _, ok := t.tree.Get(field).([]*toml.TomlTree); !ok {
+		for _, p := range t.Strings(field, required) {
+			r = append(r, Entry{Prayer: p})
+		}
+		return r
+	}
+	for _, e := range t.Tables(field) {
+		r = append(r, parseEntry(e))
+	}
+	return r
+}
+
+func parseEntry(t *tomlTable) Entry {
+	entry := Entry{Prayer: t.String("prayer", true)}
+	if when := t.String("when", false); when != "" {
+		entry.When = []string{when}
+	}
+	return entry
+}
+
+func (t *tomlTable) Ints(field string, required bool) []int {
+	r := []int{}
+	if !t.tree.Has(field) {
+		if required {
+			t.fail(field, "missing required field")
+		}
+		return r
+	}
+	list, ok := t.tree.Get(field).([]interface{})
+	if !ok {
+		t.fail(field, "expected a list of integers, found %v", describeValue(t.tree.Get(field)))
+		return r
+	}
+	for i, v := range list {
+		n, ok := v.(int64)
+		if !ok {
+			t.fail(field, "entry %v: expected an integer, found %v", i+1, describeValue(v))
+			continue
+		}
+		r = append(r, int(n))
+	}
+	return r
+}
+
+// Table returns the named subtable, or nil if it is absent or not a table
+func (t *tomlTable) Table(field string) *tomlTable {
+	if !t.tree.Has(field) {
+		return nil
+	}
+	sub, ok := t.tree.Get(field).(*toml.TomlTree)
+	if !ok {
+		t.fail(field, "expected a table, found %v", describeValue(t.tree.Get(field)))
+		return nil
+	}
+	key := field
+	if t.key != "" {
+		key = t.key + "." + field
+	}
+	return newTomlTable(t.file, key, sub, t.errs)
+}
+
+// Tables returns the entries of the named array of tables, keyed as field[1], field[2], etc
+func (t *tomlTable) Tables(field string) []*tomlTable {
+	r := []*tomlTable{}
+	if !t.tree.Has(field) {
+		return r
+	}
+	list, ok := t.tree.Get(field).([]*toml.TomlTree)
+	if !ok {
+		t.fail(field, "expected an array of tables, found %v", describeValue(t.tree.Get(field)))
+		return r
+	}
+	key := field
+	if t.key != "" {
+		key = t.key + "." + field
+	}
+	for i, sub := range list {
+		r = append(r, newTomlTable(t.file, fmt.Sprintf("%v[%v]", key, i+1), sub, t.errs))
+	}
+	return r
+}
+
+func describeValue(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return fmt.Sprintf("string %q", x)
+	case int64:
+		return fmt.Sprintf("integer %v", x)
+	case float64:
+		return fmt.Sprintf("float %v", x)
+	case bool:
+		return fmt.Sprintf("boolean %v", x)
+	case []interface{}, []*toml.TomlTree:
+		return "a list"
+	case *toml.TomlTree:
+		return "a table"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// rootTable wraps the named top level table of data, or returns nil if absent
+func rootTable(file string, data *toml.TomlTree, key string, errs *ErrorList) *tomlTable {
+	return newTomlTable(file, "", data, errs).Table(key)
+}
+
+func ParsePrayers(file string, data *toml.TomlTree) (map[string]*Prayer, error) {
+	var errs ErrorList
 	prayers := make(map[string]*Prayer)
-	//	pbag, _ := data.Query("$.prayers")
-	if data.Has("prayer") {
-		pbag := data.Get("prayer").(*toml.TomlTree)
+	if pbag := rootTable(file, data, "prayer", &errs); pbag != nil {
 		for _, p := range pbag.Keys() {
-			po := pbag.Get(p).(*toml.TomlTree)
-			prayers[p] = ParsePrayer(p, po)
-			//fmt.Printf("beep: %v,%v,%v\n", i, p, pbag.Get(p))
-
+			if po := pbag.Table(p); po != nil {
+				prayers[p] = parsePrayer(po, p)
+			}
 		}
 	}
-	return prayers
+	return prayers, errs.Err()
+}
+
+func ParsePrayer(file string, key string, po *toml.TomlTree) (*Prayer, error) {
+	var errs ErrorList
+	p := parsePrayer(newTomlTable(file, "prayer."+key, po, &errs), key)
+	return p, errs.Err()
 }
 
-func ParsePrayer(key string, po *toml.TomlTree) *Prayer {
-	np := NewPrayer(key, po.Get("name").(string))
+func parsePrayer(po *tomlTable, key string) *Prayer {
+	np := NewPrayer(key, po.String("name", true))
 	if po.Has("filename") {
-		np.SetFilename(po.Get("filename").(string))
+		np.SetFilename(po.String("filename", false))
 	}
-	if po.Has("filenames") {
-		for _, f := range po.Get("filenames").([]interface{}) {
-			np.AddFilename(f.(string))
-		}
+	for _, f := range po.Strings("filenames", false) {
+		np.AddFilename(f)
 	}
+	parseTakes(po, np)
 	if po.Has("text") {
-		np.SetText(po.Get("text").(string))
+		np.SetText(po.String("text", false))
 	}
 	if po.Has("desc") {
-		np.SetDesc(po.Get("desc").(string))
+		np.SetDesc(po.String("desc", false))
 	}
-	if po.Has("options") {
-		list := po.Get("options").(*toml.TomlTree)
-		for i := 1; i <= len(list.Keys()); i++ {
-			po2 := list.Get(strconv.Itoa(i)).(*toml.TomlTree)
-			np.AddOption(ParsePrayer(key, po2))
+	np.Lang = parseLocalized(po, "name", "text", "desc")
+	if list := po.Table("options"); list != nil {
+		indexes := map[int]string{}
+		for _, k := range list.Keys() {
+			po2 := list.Table(k)
+			if po2 == nil {
+				continue
+			}
+			option := parsePrayer(po2, key)
+			if n, err := strconv.Atoi(k); err == nil {
+				if n < 1 {
+					po2.fail("", "numbered options start at 1")
+				}
+				if po2.Has("index") {
+					po2.fail("index", "only allowed on a named option")
+				}
+				option.Index = n
+			} else {
+				option.OptionKey = k
+				option.Index = po2.Int("index", false)
+				if option.Index < 0 {
+					po2.fail("index", "must not be negative")
+				}
+			}
+			if other, ok := indexes[option.Index]; ok && option.Index > 0 {
+				po2.fail("", "option %v is also option '%v'", option.Index, other)
+			}
+			indexes[option.Index] = k
+			np.AddOption(option)
 		}
+		sort.SliceStable(np.Options, func(i, j int) bool {
+			a, b := np.Options[i].Index, np.Options[j].Index
+			return a > 0 && (b == 0 || a < b)
+		})
 	}
 	return np
 }
 
-func ParseStructures(data *toml.TomlTree) map[string]*Structure {
+// parseTakes reads the takes of a prayer, each either a filename or a
+// list of filenames, and the policy choosing between them
+func parseTakes(po *tomlTable, np *Prayer) {
+	if po.Has("policy") {
+		np.SetPolicy(po.String("policy", false))
+		if !IsTakePolicy(np.Policy) {
+			po.fail("policy", "must be one of %v, not %q", strings.Join(TakePolicies, ", "), np.Policy)
+		}
+	}
+	if !po.Has("takes") {
+		return
+	}
+	list, ok := po.tree.Get("takes").([]interface{})
+	if !ok {
+		po.fail("takes", "expected a list of filenames or of lists of filenames, found %v", describeValue(po.tree.Get("takes")))
+		return
+	}
+	for i, v := range list {
+		switch take := v.(type) {
+		case string:
+			np.AddTake(take)
+		case []interface{}:
+			files := make([]string, 0, len(take))
+			for _, f := range take {
+				if name, ok := f.(string); ok {
+					files = append(files, name)
+				} else {
+					po.fail("takes", "take %v: expected a filename, found %v", i+1, describeValue(f))
+				}
+			}
+			np.AddTake(files...)
+		default:
+			po.fail("takes", "take %v: expected a filename or a list of filenames, found %v", i+1, describeValue(v))
+		}
+	}
+}
+
+// ParseStructures reads the [structure] tables of data. Structures that
+// extend others are left for ResolveStructures, once every file is merged.
+func ParseStructures(file string, data *toml.TomlTree) (map[string]*Structure, error) {
+	var errs ErrorList
 	structures := make(map[string]*Structure)
-	//	pbag, _ := data.Query("$.prayers")
-	if data.Has("structure") {
-		sbag := data.Get("structure").(*toml.TomlTree)
+	if sbag := rootTable(file, data, "structure", &errs); sbag != nil {
 		for _, s := range sbag.Keys() {
-			so := sbag.Get(s).(*toml.TomlTree)
-			structures[s] = ParseStructure(s, so)
-			//fmt.Printf("beep: %v,%v,%v\n", i, p, pbag.Get(p))
+			if so := sbag.Table(s); so != nil {
+				structures[s] = parseStructure(so, s)
+			}
+		}
+	}
+	return structures, errs.Err()
+}
+
+func ParseStructure(file string, key string, so *toml.TomlTree) (*Structure, error) {
+	var errs ErrorList
+	s := parseStructure(newTomlTable(file, "structure."+key, so, &errs), key)
+	return s, errs.Err()
+}
 
+func parseStructure(so *tomlTable, key string) *Structure {
+	extends := so.String("extends", false)
+	ns := NewStructure(key, so.String("name", extends == ""))
+	legacy := false
+	for _, name := range SectionNames {
+		legacy = legacy || so.Has(name)
+	}
+	if so.Has("section") {
+		if legacy {
+			so.fail("section", "use either section tables or preamble, group, mystery and postamble lists, not both")
+		}
+		if so.Has("repeat") {
+			so.fail("repeat", "repeat belongs on a section when section tables are used")
+		}
+		ns.Sections = []*Section{}
+		for _, sub := range so.Tables("section") {
+			ns.Sections = append(ns.Sections, parseSection(sub, false))
+		}
+	} else {
+		for _, name := range SectionNames {
+			for _, e := range so.Entries(name, false) {
+				ns.addEntry(name, e)
+			}
+		}
+	}
+	if options := so.Table("options"); options != nil {
+		parseOptions(options, ns.Options)
+	}
+	if seasonal := so.Table("seasonal"); seasonal != nil {
+		for _, season := range seasonal.Keys() {
+			if !isSeason(season) {
+				seasonal.fail(season, "expected a season (%v)", strings.Join(Seasons, ", "))
+				continue
+			}
+			replacements := map[string][]Entry{}
+			parsePrayerTable(seasonal.Table(season), replacements)
+			for _, k := range sortedKeys(replacements) {
+				ns.SetSeasonal(season, k, replacements[k])
+			}
+		}
+	}
+	if when := so.Table("when"); when != nil {
+		for _, k := range when.Keys() {
+			ns.SetWhen(k, when.String(k, false))
+		}
+	}
+	repeat := so.Int("repeat", false)
+	if repeat < 0 {
+		so.fail("repeat", "must not be negative")
+	}
+	if extends != "" {
+		e := ns.SetExtends(extends)
+		if so.Has("section") {
+			e.Sections = ns.Sections
+		}
+		if so.Has("repeat") {
+			e.Repeat = &repeat
+		}
+		for _, k := range so.Keys() {
+			switch {
+			case legacy && isSectionName(k):
+				e.Prayers[k] = ns.Section(k).Entries
+			case strings.HasSuffix(k, "_prepend"):
+				e.Prepend[strings.TrimSuffix(k, "_prepend")] = so.Entries(k, false)
+			case strings.HasSuffix(k, "_append"):
+				e.Append[strings.TrimSuffix(k, "_append")] = so.Entries(k, false)
+			}
+		}
+		parsePrayerTable(so.Table("replace"), e.Replace)
+		parsePrayerTable(so.Table("insert_before"), e.InsertBefore)
+		parsePrayerTable(so.Table("insert_after"), e.InsertAfter)
+	} else {
+		if repeat > 0 {
+			if err := ns.SetRepeat(repeat); err != nil {
+				so.fail("repeat", "%v", err)
+			}
+		}
+		for _, k := range so.Keys() {
+			if k == "replace" || k == "insert_before" || k == "insert_after" || strings.HasSuffix(k, "_prepend") || strings.HasSuffix(k, "_append") {
+				so.fail(k, "only allowed in a structure that extends another")
+			}
 		}
 	}
-	return structures
+	return ns
 }
 
-func ParseStructure(key string, so *toml.TomlTree) *Structure {
-	ns := NewStructure(key, so.Get("name").(string))
-	if so.Has("preamble") {
-		for _, p := range so.Get("preamble").([]interface{}) {
-			ns.AddPreamble(p.(string))
+func isSectionName(name string) bool {
+	for _, n := range SectionNames {
+		if n == name {
+			return true
 		}
 	}
+	return false
+}
 
-	if so.Has("group") {
-		for _, p := range so.Get("group").([]interface{}) {
-			ns.AddGroup(p.(string))
+// parseSection reads one [[section]] table and its subsections
+func parseSection(so *tomlTable, inGroup bool) *Section {
+	name := so.String("name", false)
+	key := so.String("key", false)
+	if key == "" {
+		key = strings.ToLower(strings.Replace(name, " ", "", -1))
+	}
+	ns := NewSection(key, name)
+	ns.ForEach = so.String("foreach", false)
+	switch ns.ForEach {
+	case "":
+	case "group":
+		if inGroup {
+			so.fail("foreach", "a section for each group cannot be inside another")
 		}
+	case "mystery":
+		if !inGroup {
+			so.fail("foreach", "a section for each mystery must be inside a section for each group")
+		}
+	default:
+		so.fail("foreach", "must be \"group\" or \"mystery\", not %q", ns.ForEach)
+	}
+	ns.Repeat = so.Int("repeat", false)
+	if ns.Repeat < 0 {
+		so.fail("repeat", "must not be negative")
+	}
+	if ns.Repeat > 0 && ns.ForEach != "" {
+		so.fail("repeat", "use either foreach or repeat, not both")
 	}
+	if vars := so.Table("vars"); vars != nil {
+		for _, k := range vars.Keys() {
+			ns.SetVar(k, vars.String(k, false))
+		}
+	}
+	for _, e := range so.Entries("prayers", false) {
+		ns.AddEntry(e)
+	}
+	for _, sub := range so.Tables("section") {
+		ns.AddSection(parseSection(sub, inGroup || ns.ForEach == "group"))
+	}
+	return ns
+}
 
-	if so.Has("mystery") {
-		for _, p := range so.Get("mystery").([]interface{}) {
-			ns.AddMystery(p.(string))
+// parsePrayerTable reads a table of prayer = "prayer" or prayer = [ "prayers" ] entries into m.
+// Either form may also be given as { prayer = "key", when = "template" } tables.
+func parsePrayerTable(t *tomlTable, m map[string][]Entry) {
+	if t == nil {
+		return
+	}
+	for _, k := range t.Keys() {
+		switch t.tree.Get(k).(type) {
+		case string:
+			m[k] = []Entry{{Prayer: t.String(k, false)}}
+		case *toml.TomlTree:
+			m[k] = []Entry{parseEntry(t.Table(k))}
+		default:
+			m[k] = t.Entries(k, false)
 		}
 	}
+}
 
-	if so.Has("postamble") {
-		for _, p := range so.Get("postamble").([]interface{}) {
-			ns.AddPostamble(p.(string))
+// ParseBlocks reads the [block] tables of data, each a named list of
+// prayers that structures may refer to as "@name"
+func ParseBlocks(file string, data *toml.TomlTree) (map[string][]Entry, error) {
+	var errs ErrorList
+	blocks := make(map[string][]Entry)
+	if bbag := rootTable(file, data, "block", &errs); bbag != nil {
+		for _, b := range bbag.Keys() {
+			if bo := bbag.Table(b); bo != nil {
+				blocks[b] = bo.Entries("prayers", true)
+			}
 		}
 	}
-	return ns
+	return blocks, errs.Err()
 }
 
-func ParseMysteries(data *toml.TomlTree) map[string]*Mystery {
+func ParseMysteries(file string, data *toml.TomlTree) (map[string]*Mystery, error) {
+	var errs ErrorList
 	mysteries := make(map[string]*Mystery)
-	//	pbag, _ := data.Query("$.prayers")
-	if data.Has("mystery") {
-		sbag := data.Get("mystery").(*toml.TomlTree)
+	if sbag := rootTable(file, data, "mystery", &errs); sbag != nil {
 		for _, s := range sbag.Keys() {
-			so := sbag.Get(s).(*toml.TomlTree)
 			num, err := strconv.Atoi(s)
 			if err != nil {
-				log.Fatalf("Could not parse '%v' as an int.", s)
+				sbag.fail(s, "mystery keys must be numbers")
+				continue
+			}
+			if so := sbag.Table(s); so != nil {
+				mysteries[s] = parseMystery(so, num)
 			}
-			mysteries[s] = ParseMystery(num, so)
-
 		}
 	}
-	return mysteries
+	return mysteries, errs.Err()
 }
 
-func ParseMystery(num int, so *toml.TomlTree) *Mystery {
-	ns := NewMystery(num, so.Get("name").(string))
+func ParseMystery(file string, num int, so *toml.TomlTree) (*Mystery, error) {
+	var errs ErrorList
+	m := parseMystery(newTomlTable(file, "mystery."+strconv.Itoa(num), so, &errs), num)
+	return m, errs.Err()
+}
+
+func parseMystery(so *tomlTable, num int) *Mystery {
+	ns := NewMystery(num, so.String("name", true))
 	if so.Has("desc") {
-		ns.SetDesc(so.Get("desc").(string))
+		ns.SetDesc(so.String("desc", false))
+	}
+	if so.Has("scripture") {
+		ns.SetScripture(so.String("scripture", false))
+	}
+	if so.Has("fruit") {
+		ns.SetFruit(so.String("fruit", false))
+	}
+	if so.Has("meditation") {
+		ns.SetMeditation(so.String("meditation", false))
+	}
+	for _, vo := range so.Tables("verse") {
+		ns.AddVerse(vo.String("text", true), vo.String("filename", false))
 	}
+	ns.Lang = parseLocalized(so, "name", "desc", "fruit", "meditation")
 
 	return ns
 }
 
-func ParseGroups(data *toml.TomlTree) map[string]*Group {
+func ParseGroups(file string, data *toml.TomlTree) (map[string]*Group, error) {
+	var errs ErrorList
 	groups := make(map[string]*Group)
-	//	pbag, _ := data.Query("$.prayers")
-	if data.Has("group") {
-		sbag := data.Get("group").(*toml.TomlTree)
+	if sbag := rootTable(file, data, "group", &errs); sbag != nil {
 		for _, s := range sbag.Keys() {
-			so := sbag.Get(s).(*toml.TomlTree)
-			groups[s] = ParseGroup(s, so)
-			//fmt.Printf("beep: %v,%v,%v\n", i, p, pbag.Get(p))
-
+			if so := sbag.Table(s); so != nil {
+				groups[s] = parseGroup(so, s)
+			}
 		}
 	}
-	return groups
+	return groups, errs.Err()
 }
 
-func ParseGroup(key string, so *toml.TomlTree) *Group {
-	ns := NewGroup(int(so.Get("order").(int64)), key, so.Get("name").(string))
-	for _, p := range so.Get("mysteries").([]interface{}) {
-		ns.AddMystery(int(p.(int64)))
+func ParseGroup(file string, key string, so *toml.TomlTree) (*Group, error) {
+	var errs ErrorList
+	g := parseGroup(newTomlTable(file, "group."+key, so, &errs), key)
+	return g, errs.Err()
+}
+
+func parseGroup(so *tomlTable, key string) *Group {
+	ns := NewGroup(so.Int("order", true), key, so.String("name", true))
+	for _, p := range so.Ints("mysteries", true) {
+		ns.AddMystery(p)
 	}
+	ns.Lang = parseLocalized(so, "name")
 
 	return ns
 }
 
-func ParseOptions(data *toml.TomlTree) *Options {
+// parseLocalized reads the [lang.xx] subtables of t, each translating
+// some of fields into the language xx
+func parseLocalized(t *tomlTable, fields ...string) Localized {
+	l := Localized{}
+	lo := t.Table("lang")
+	if lo == nil {
+		return l
+	}
+	for _, lang := range lo.Keys() {
+		so := lo.Table(lang)
+		if so == nil {
+			continue
+		}
+		for _, k := range so.Keys() {
+			known := false
+			for _, f := range fields {
+				known = known || f == k
+			}
+			if !known {
+				so.fail(k, "cannot be translated, expected one of %v", strings.Join(fields, ", "))
+				continue
+			}
+			l.Set(lang, k, so.String(k, false))
+		}
+	}
+	return l
+}
+
+// ParseLanguages reads the [language] tables of data
+func ParseLanguages(file string, data *toml.TomlTree) (map[string]*Language, error) {
+	var errs ErrorList
+	languages := make(map[string]*Language)
+	if lbag := rootTable(file, data, "language", &errs); lbag != nil {
+		for _, k := range lbag.Keys() {
+			if lo := lbag.Table(k); lo != nil {
+				l := NewLanguage(k, lo.String("name", true))
+				l.Ordinals = lo.Strings("ordinals", false)
+				l.StandaloneOrdinals = lo.Strings("standaloneordinals", false)
+				l.Counts = lo.Strings("counts", false)
+				l.XthGroupMystery = lo.String("xthgroupmystery", false)
+				l.XofGroup = lo.String("xofgroup", false)
+				l.Preamble = lo.String("preamble", false)
+				l.Postamble = lo.String("postamble", false)
+				l.InputDirs = lo.Strings("idirs", false)
+				languages[k] = l
+			}
+		}
+	}
+	return languages, errs.Err()
+}
+
+// ParseGroupSets reads the [groupset] tables of data, each naming a list of groups
+func ParseGroupSets(file string, data *toml.TomlTree) (map[string]*GroupSet, error) {
+	var errs ErrorList
+	sets := make(map[string]*GroupSet)
+	if sbag := rootTable(file, data, "groupset", &errs); sbag != nil {
+		for _, k := range sbag.Keys() {
+			if so := sbag.Table(k); so != nil {
+				// -groups is matched in lowercase
+				key := strings.ToLower(k)
+				name := so.String("name", false)
+				if name == "" {
+					name = k
+				}
+				gs := NewGroupSet(key, name)
+				for _, g := range so.Strings("groups", true) {
+					gs.AddGroup(strings.ToLower(g))
+				}
+				sets[key] = gs
+			}
+		}
+	}
+	return sets, errs.Err()
+}
+
+// ParseWeekdays reads the [weekday] table of data, naming the groups said
+// on each day of the week, with subtables for days that differ in a season
+func ParseWeekdays(file string, data *toml.TomlTree) (*Weekdays, error) {
+	var errs ErrorList
+	weekdays := NewWeekdays()
+	if wbag := rootTable(file, data, "weekday", &errs); wbag != nil {
+		for _, k := range wbag.Keys() {
+			switch {
+			case isWeekdayName(k):
+				weekdays.SetDay(k, parseWeekdayGroups(wbag, k))
+			case isSeason(k):
+				if so := wbag.Table(k); so != nil {
+					for _, d := range so.Keys() {
+						if isWeekdayName(d) {
+							weekdays.SetSeasonDay(k, d, parseWeekdayGroups(so, d))
+						} else {
+							so.fail(d, "expected a day of the week (%v)", strings.Join(WeekdayNames, ", "))
+						}
+					}
+				}
+			default:
+				wbag.fail(k, "expected a day of the week (%v) or a season (%v)", strings.Join(WeekdayNames, ", "), strings.Join(Seasons, ", "))
+			}
+		}
+	}
+	return weekdays, errs.Err()
+}
+
+func parseWeekdayGroups(t *tomlTable, day string) string {
+	groups := strings.ToLower(t.String(day, true))
+	if groups == "today" {
+		t.fail(day, "must name the groups for the day, not \"today\"")
+		return ""
+	}
+	return groups
+}
+
+func ParseOptions(file string, data *toml.TomlTree) (*Options, error) {
+	var errs ErrorList
 	options := NewOptions()
-	if data.Has("options") {
-		sbag := data.Get("options").(*toml.TomlTree)
-		for _, s := range sbag.Keys() {
-			so := sbag.Get(s).(int64)
-			options.AddOption(s, int(so))
+	if sbag := rootTable(file, data, "options", &errs); sbag != nil {
+		parseOptions(sbag, options)
+	}
+	return options, errs.Err()
+}
 
+// parseOptions reads a table of prayer = choice entries into options,
+// where a choice is an option's index or key.
+// In place of a choice, a prayer may have a table with an optional
+// option and a list of rule tables, each with a when template and an option.
+func parseOptions(t *tomlTable, options *Options) {
+	for _, k := range t.Keys() {
+		if _, ok := t.tree.Get(k).(*toml.TomlTree); !ok {
+			options.AddOption(k, t.Choice(k, true))
+			continue
+		}
+		po := t.Table(k)
+		if po.Has("option") {
+			options.AddOption(k, po.Choice("option", false))
+		}
+		for _, r := range po.Tables("rule") {
+			options.AddRule(k, r.String("when", true), r.Choice("option", true))
+		}
+		if !po.Has("option") && !po.Has("rule") {
+			po.fail("", "expected an option or rules")
 		}
 	}
-	return options
 }
 
 // Merge functions return a with b's entries added, possibly replacing a's entries
@@ -170,6 +813,20 @@ func MergeStructures(a map[string]*Structure, b map[string]*Structure) map[strin
 	return a
 }
 
+func MergeBlocks(a map[string][]Entry, b map[string][]Entry) map[string][]Entry {
+	for k, v := range b {
+		a[k] = v
+	}
+	return a
+}
+
+func MergeGroupSets(a map[string]*GroupSet, b map[string]*GroupSet) map[string]*GroupSet {
+	for k, v := range b {
+		a[k] = v
+	}
+	return a
+}
+
 func MergeMysteries(a map[string]*Mystery, b map[string]*Mystery) map[string]*Mystery {
 	for k, v := range b {
 		a[k] = v
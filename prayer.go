@@ -1,6 +1,10 @@
 package rosarygen
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 type (
 	Prayer struct {
@@ -11,9 +15,34 @@ type (
 		Filename  string
 		Filenames []string
 		Options   []*Prayer
+
+		// Takes are alternative recordings of Filename, or of Filenames,
+		// chosen between by Policy (see TakePolicies)
+		Takes  [][]string
+		Policy string
+
+		// Index and OptionKey identify an option among its prayer's Options,
+		// which are kept in order of Index, with unindexed options last
+		Index     int
+		OptionKey string
+
+		// Lang translates Name, Text and Desc (see Generator.SetLanguage)
+		Lang Localized
 	}
 )
 
+// VerseMeditation is the key of the prayer reading the verse of the current
+// mystery for the coming Hail Mary (see StateTracker.VerseFile). It is built
+// in, but may be redefined in prayers.toml or options.toml.
+const VerseMeditation = "versemeditation"
+
+func NewVerseMeditation() *Prayer {
+	p := NewPrayer(VerseMeditation, "Verse Meditation")
+	p.SetDesc("Verse of scripture before each Hail Mary of the mystery")
+	p.SetFilename("{{.VerseFile}}")
+	return p
+}
+
 func NewPrayer(key string, name string) *Prayer {
 	return &Prayer{
 		Key:       key,
@@ -39,6 +68,15 @@ func (p *Prayer) SetFilename(filename string) {
 	p.Filename = filename
 }
 
+// AddTake adds a take made up of the given files
+func (p *Prayer) AddTake(filenames ...string) {
+	p.Takes = append(p.Takes, filenames)
+}
+
+func (p *Prayer) SetPolicy(policy string) {
+	p.Policy = policy
+}
+
 func (p *Prayer) AddOption(option *Prayer) {
 	p.Options = append(p.Options, option)
 }
@@ -47,41 +85,111 @@ func (p *Prayer) AddFilename(filename string) {
 	p.Filenames = append(p.Filenames, filename)
 }
 
-func (p *Prayer) GetChosenFilenames(o OptionProvider) []string {
-	r := make([]string, 0, 1)
-	i := o.GetOption(p.Key)
-	if len(p.Options) > 0 {
-		if i <= len(p.Options) {
-			po := p.Options[i-1]
-			r = append(r, po.GetChosenFilenames(o)...)
-		} else {
-			r = append(r, p.Filename)
-			return r
+// Option returns the option choice names, by Index ("4") or OptionKey
+// ("flameoflove"), or the first option if choice is "". It reports false
+// if the prayer has no such option.
+func (p *Prayer) Option(choice string) (*Prayer, bool) {
+	if len(p.Options) == 0 {
+		return nil, false
+	}
+	if choice == "" {
+		return p.Options[0], true
+	}
+	n, err := strconv.Atoi(choice)
+	for _, po := range p.Options {
+		if (err == nil && po.Index == n) || (err != nil && po.OptionKey == choice) {
+			return po, true
 		}
-	} else {
-		// Either no options, or we are already in an option leaf
-		if len(p.Filenames) > 0 {
-			return p.Filenames
-		} else {
-			r = append(r, p.Filename)
+	}
+	return nil, false
+}
+
+// DescribeOptions lists the ways each option may be chosen, e.g. "full (1), flameoflove (4)"
+func (p *Prayer) DescribeOptions() string {
+	r := make([]string, len(p.Options))
+	for i, po := range p.Options {
+		r[i] = po.optionName()
+	}
+	return strings.Join(r, ", ")
+}
+
+func (p *Prayer) optionName() string {
+	switch {
+	case p.OptionKey == "":
+		return strconv.Itoa(p.Index)
+	case p.Index == 0:
+		return p.OptionKey
+	default:
+		return fmt.Sprintf("%v (%v)", p.OptionKey, p.Index)
+	}
+}
+
+// ChosenOption returns the option o chooses for the prayer being said at s,
+// following options of options down to the one that is said. It returns p
+// itself if p has no options, or if o chooses an option p does not have.
+func (p *Prayer) ChosenOption(o OptionProvider, s *StateTracker) *Prayer {
+	if len(p.Options) == 0 {
+		return p
+	}
+	if po, ok := p.Option(o.GetOption(p.Key, s)); ok {
+		return po.ChosenOption(o, s)
+	}
+	return p
+}
+
+// GetChosenFilenames returns the filenames of the option o chooses
+// for the prayer being said at s
+func (p *Prayer) GetChosenFilenames(o OptionProvider, s *StateTracker) []string {
+	return p.ChosenOption(o, s).filenames(s)
+}
+
+// filenames returns the files of p itself, choosing a take if it has any
+func (p *Prayer) filenames(s *StateTracker) []string {
+	switch {
+	case len(p.Options) > 0:
+		// an option was chosen that p does not have
+		return []string{p.Filename}
+	case len(p.Takes) > 0:
+		take := 0
+		if s != nil {
+			take = s.ChooseTake(p.Key, p.Policy, len(p.Takes))
 		}
+		return p.Takes[take]
+	case len(p.Filenames) > 0:
+		return p.Filenames
+	default:
+		return []string{p.Filename}
 	}
-	return r
 }
 
 func (p *Prayer) ForEachFile(o OptionProvider, s *StateTracker, f func(filename string, p *Prayer, s *StateTracker)) {
 	s.PrayerNum += 1
+	if s.said == nil {
+		s.said = map[string]int{}
+	}
+	s.said[p.Key] += 1
 	if p.Key == "hailmary" {
 		s.HailMaryNum += 1
 	}
-	r := p.GetChosenFilenames(o)
+	s.Prayer = p.Key
+	s.PrayerName = p.Name
+	chosen := p.ChosenOption(o, s)
+	// Numbered takes are looked for only where no takes are listed
+	s.filePolicy = ""
+	if len(chosen.Takes) == 0 {
+		s.filePolicy = firstNonEmpty(chosen.Policy, p.Policy, s.TakePolicy)
+	}
+	r := chosen.filenames(s)
 	for _, file := range r {
 		s.InputFileNum += 1
-		s.Prayer = p.Key
-		s.PrayerName = p.Name
-		ofile := s.Apply(file)
+		ofile, err := s.Apply(file)
+		if err != nil {
+			// left for Err; "" would end the files
+			continue
+		}
 		f(ofile, p, s)
 	}
+	s.filePolicy = ""
 }
 
 // Utility functions to pass to ForEachFile
@@ -100,23 +208,42 @@ func PrintActualFilename(filename string, p *Prayer, s *StateTracker) {
 	fmt.Printf("%v: %v\n", filename, actual)
 }
 
+// GetFiles sends the files for each output file on ch, closing it after the
+// last. Once a template has failed (see StateTracker.Err) no more are sent.
 func GetFiles(ch chan *FileStack) func(filename string, p *Prayer, s *StateTracker) {
 	var stack *FileStack
+	var tracker *StateTracker
+	done := false
+	stop := func() {
+		done = true
+		close(ch)
+	}
 	return func(filename string, p *Prayer, s *StateTracker) {
-		if stack == nil {
-			s.UpdateFilename()
-			stack = NewFileStack(s.LastFilename)
-		} else {
-			if filename == "" {
-				// Last file
-				ch <- stack
-				close(ch)
-				return
-			}
-			if s.UpdateFilename() {
+		if done {
+			return
+		}
+		if s != nil {
+			tracker = s
+		}
+		if filename == "" {
+			// Last file
+			if stack != nil && tracker.Err() == nil {
 				ch <- stack
-				stack = NewFileStack(s.LastFilename)
 			}
+			stop()
+			return
+		}
+		changed, err := s.UpdateFilename()
+		if err != nil || s.Err() != nil {
+			// stop before another file is written
+			stop()
+			return
+		}
+		if stack == nil {
+			stack = NewFileStack(s.LastFilename)
+		} else if changed {
+			ch <- stack
+			stack = NewFileStack(s.LastFilename)
 		}
 		actual, err := s.MatchActualFile(filename)
 		if err == nil {
@@ -3,56 +3,169 @@ package rosarygen
 import (
 	"fmt"
 	"strconv"
+	"strings"
 )
 
+// Rosary is a Structure expanded for a particular list of groups
+// of mysteries into the tree of prayers that will be said
 type Rosary struct {
-	Preamble  []*Prayer
-	Decades   []*Decade
-	Postamble []*Prayer
+	Name     string
+	Options  *Options // the structure's options, used over those given to ForEachFile
+	Segments []*Segment
 }
 
+// Segment is one pass through a Section of a Structure
+type Segment struct {
+	Section *Section
+
+	// Group is the group of mysteries being said, and Mysteries its mysteries.
+	// Mystery is set for a pass of a section said for each mystery.
+	Group     *Group
+	Mysteries []*Mystery
+	Mystery   *Mystery
+
+	// Num counts passes through a section with ForEach or Repeat set,
+	// from 1 to Count. Both are 0 for a section said once.
+	Num   int
+	Count int
+
+	Steps    []*Step
+	Segments []*Segment
+}
+
+// Step is one prayer of a Segment, said only if each of its When templates
+// is true when it is reached. During a season in Seasonal, the steps
+// given for that season are said in its place.
+type Step struct {
+	Prayer   *Prayer
+	When     []string
+	Seasonal map[string][]*Step
+}
+
+// NewRosary expands structure for groups. Prayers the structure names that are
+// not in prayers are left out; Generator.Validate reports them.
 func NewRosary(structure *Structure, groups []*Group, mysteries map[string]*Mystery, prayers map[string]*Prayer) *Rosary {
-	pergroup := []*Prayer{}
-	r := &Rosary{
-		Preamble:  []*Prayer{},
-		Decades:   []*Decade{},
-		Postamble: []*Prayer{},
-	}
-	for _, s := range structure.Preamble {
-		r.Preamble = append(r.Preamble, prayers[s])
-	}
-	for _, s := range structure.Postamble {
-		r.Postamble = append(r.Postamble, prayers[s])
-	}
-	for _, s := range structure.Group {
-		pergroup = append(pergroup, prayers[s])
-	}
-	for _, g := range groups {
-		nms := []*Mystery{}
-		for _, mi := range g.Mysteries {
-			m := mysteries[strconv.Itoa(mi)]
-			nm := NewMystery(m.Num, m.Name)
-			for _, s := range structure.Mystery {
-				nm.Prayers = append(nm.Prayers, prayers[s])
+	b := &rosaryBuilder{
+		seasonal:  structure.Seasonal,
+		groups:    groups,
+		mysteries: mysteries,
+		prayers:   prayers,
+	}
+	return &Rosary{
+		Name:     structure.Name,
+		Options:  structure.Options,
+		Segments: b.expand(structure.Sections, nil),
+	}
+}
+
+type rosaryBuilder struct {
+	seasonal  map[string]map[string][]Entry
+	groups    []*Group
+	mysteries map[string]*Mystery
+	prayers   map[string]*Prayer
+}
+
+func (b *rosaryBuilder) expand(sections []*Section, group *Group) []*Segment {
+	r := []*Segment{}
+	for _, section := range sections {
+		switch {
+		case section.ForEach == "group":
+			for i, g := range b.groups {
+				r = append(r, b.segment(section, g, nil, i+1, len(b.groups)))
+			}
+		case section.ForEach == "mystery":
+			ms := b.mysteriesOf(group)
+			for i, m := range ms {
+				r = append(r, b.segment(section, group, m, i+1, len(ms)))
 			}
-			nms = append(nms, nm)
+		case section.Repeat > 0:
+			for i := 1; i <= section.Repeat; i++ {
+				r = append(r, b.segment(section, group, nil, i, section.Repeat))
+			}
+		default:
+			r = append(r, b.segment(section, group, nil, 0, 0))
+		}
+	}
+	return r
+}
+
+func (b *rosaryBuilder) segment(section *Section, group *Group, mystery *Mystery, num int, count int) *Segment {
+	seg := &Segment{
+		Section:   section,
+		Group:     group,
+		Mysteries: b.mysteriesOf(group),
+		Mystery:   mystery,
+		Num:       num,
+		Count:     count,
+		Steps:     []*Step{},
+	}
+	for _, e := range section.Entries {
+		if step := b.step(e); step != nil {
+			for _, season := range sortedKeys(b.seasonal) {
+				if replacements, ok := b.seasonal[season][e.Prayer]; ok {
+					if step.Seasonal == nil {
+						step.Seasonal = map[string][]*Step{}
+					}
+					step.Seasonal[season] = b.steps(replacements)
+				}
+			}
+			seg.Steps = append(seg.Steps, step)
 		}
-		r.Decades = append(r.Decades, NewDecade(g.Name, pergroup, nms...))
+	}
+	seg.Segments = b.expand(section.Sections, group)
+	return seg
+}
 
+func (b *rosaryBuilder) step(e Entry) *Step {
+	if p, ok := b.prayers[e.Prayer]; ok {
+		return &Step{Prayer: p, When: e.When}
+	}
+	return nil
+}
+
+func (b *rosaryBuilder) steps(entries []Entry) []*Step {
+	r := []*Step{}
+	for _, e := range entries {
+		if step := b.step(e); step != nil {
+			r = append(r, step)
+		}
 	}
 	return r
 }
 
-func (r *Rosary) GetPrayers() []*Prayer {
-	s := []*Prayer{}
-	for _, p := range r.Preamble {
-		s = append(s, p)
+func (b *rosaryBuilder) mysteriesOf(group *Group) []*Mystery {
+	ms := []*Mystery{}
+	if group == nil {
+		return ms
+	}
+	for _, mi := range group.Mysteries {
+		if m, ok := b.mysteries[strconv.Itoa(mi)]; ok {
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
+
+// Override chooses the options of o over the rosary's own and those given to ForEachFile
+func (r *Rosary) Override(o *Options) {
+	if o == nil || len(o.Prayers()) == 0 {
+		return
 	}
-	for _, d := range r.Decades {
-		s = append(s, d.GetPrayers()...)
+	options := NewOptions()
+	if r.Options != nil {
+		options.Merge(r.Options)
 	}
-	for _, p := range r.Postamble {
-		s = append(s, p)
+	options.Merge(o)
+	r.Options = options
+}
+
+// GetPrayers lists every prayer of the rosary in order, including
+// those that are only said when their conditions are met, but not
+// those said in their place in particular seasons
+func (r *Rosary) GetPrayers() []*Prayer {
+	s := []*Prayer{}
+	for _, seg := range r.Segments {
+		s = append(s, seg.GetPrayers()...)
 	}
 	return s
 }
@@ -61,98 +174,238 @@ func (r *Rosary) ForEachFile(idirs []string, odir string, outputFilename string,
 	if s == nil {
 		s = NewStateTracker(idirs, odir, outputFilename, format)
 	}
-
-	for _, p := range r.Preamble {
-		p.ForEachFile(o, s, f)
-	}
-	for _, d := range r.Decades {
-		d.ForEachFile(o, s, f)
+	if r.Options != nil && len(r.Options.Prayers()) > 0 {
+		o = NewLayeredOptions(r.Options, o)
 	}
-	s.Group = "Postamble"
-	s.GroupNum += 1
-	s.MysteryNum = 0
-	s.Mystery = ""
-	for _, p := range r.Postamble {
-		p.ForEachFile(o, s, f)
+
+	for _, seg := range r.Segments {
+		seg.ForEachFile(o, s, f)
 	}
 	f("", nil, nil)
 }
 
-func (r *Rosary) RenderToFiles(idirs []string, odir string, outputFilename string, format string, o OptionProvider, gapLength int, s *StateTracker) {
+// RenderToFiles renders the rosary into the output files. It stops before
+// writing another file once a template has failed, returning the errors.
+func (r *Rosary) RenderToFiles(idirs []string, odir string, outputFilename string, format string, o OptionProvider, gapLength int, s *StateTracker) error {
+	if s == nil {
+		s = NewStateTracker(idirs, odir, outputFilename, format)
+	}
 	ch := make(chan *FileStack)
-	go r.ForEachFile(idirs, odir, outputFilename, format, o, GetFiles(ch), s)
+	finished := make(chan bool)
+	go func() {
+		r.ForEachFile(idirs, odir, outputFilename, format, o, GetFiles(ch), s)
+		close(finished)
+	}()
 	for f := range ch {
 		f.RenderWav(gapLength)
 	}
+	<-finished
+	return s.Err()
 }
 
-type Decade struct {
-	Name      string
-	Group     []*Prayer
-	Mysteries []*Mystery
+// Compile compiles every template the rosary may use into s before anything
+// is said: the output filename, s's language, the names, vars and conditions
+// of sections, the filenames and takes of every prayer and its options, and
+// the rules of o and of the rosary's own options. It returns every error
+// found, so that a bad template is reported before any file is written.
+func (r *Rosary) Compile(s *StateTracker, o *Options) error {
+	c := &rosaryCompiler{
+		s:        s,
+		sections: map[*Section]bool{},
+		prayers:  map[*Prayer]bool{},
+	}
+	c.compile("output filename", s.outputTemplate())
+	if l := s.Language; l != nil {
+		c.compile("language '"+l.Key+"' xthgroupmystery", l.XthGroupMystery)
+		c.compile("language '"+l.Key+"' xofgroup", l.XofGroup)
+	}
+	for _, opts := range []*Options{o, r.Options} {
+		if opts == nil {
+			continue
+		}
+		for _, k := range opts.Prayers() {
+			for _, rule := range opts.Rules[k] {
+				c.compile("option rule for '"+k+"'", rule.When)
+			}
+		}
+	}
+	c.segments(r.Segments)
+	return c.errs.Err()
 }
 
-func NewDecade(name string, group []*Prayer, mysteries ...*Mystery) *Decade {
-	return &Decade{
-		Name:      name,
-		Group:     group,
-		Mysteries: mysteries,
+type rosaryCompiler struct {
+	s        *StateTracker
+	sections map[*Section]bool
+	prayers  map[*Prayer]bool
+	errs     ErrorList
+}
+
+func (c *rosaryCompiler) compile(where string, name string) {
+	if err := c.s.Compile(name); err != nil {
+		c.errs.Add(fmt.Errorf("%v: %v", where, err))
+	}
+}
+
+func (c *rosaryCompiler) segments(segs []*Segment) {
+	for _, seg := range segs {
+		if section := seg.Section; !c.sections[section] {
+			c.sections[section] = true
+			where := "section '" + section.Key + "'"
+			c.compile(where+" name", section.Name)
+			for _, k := range sortedKeys(section.Vars) {
+				c.compile(where+" var "+k, section.Vars[k])
+			}
+			c.steps(where, seg.Steps)
+		}
+		c.segments(seg.Segments)
+	}
+}
+
+func (c *rosaryCompiler) steps(where string, steps []*Step) {
+	for _, step := range steps {
+		for _, when := range step.When {
+			c.compile(where+" condition for '"+step.Prayer.Key+"'", when)
+		}
+		c.prayer("prayer '"+step.Prayer.Key+"'", step.Prayer)
+		for _, season := range sortedKeys(step.Seasonal) {
+			c.steps(where+" "+season, step.Seasonal[season])
+		}
+	}
+}
+
+func (c *rosaryCompiler) prayer(where string, p *Prayer) {
+	if c.prayers[p] {
+		return
+	}
+	c.prayers[p] = true
+	c.compile(where+" filename", p.Filename)
+	for _, f := range p.Filenames {
+		c.compile(where+" filenames", f)
+	}
+	for i, take := range p.Takes {
+		for _, f := range take {
+			c.compile(fmt.Sprintf("%v take %v", where, i+1), f)
+		}
+	}
+	for _, po := range p.Options {
+		c.prayer(where+" option "+po.optionName(), po)
 	}
 }
 
-func (d *Decade) GetPrayers() []*Prayer {
+func (seg *Segment) GetPrayers() []*Prayer {
 	s := []*Prayer{}
-	for _, p := range d.Group {
-		s = append(s, p)
+	for _, step := range seg.Steps {
+		s = append(s, step.Prayer)
 	}
-	for _, m := range d.Mysteries {
-		s = append(s, m.GetPrayers()...)
+	for _, sub := range seg.Segments {
+		s = append(s, sub.GetPrayers()...)
 	}
 	return s
 }
 
-func (d *Decade) ForEachFile(o OptionProvider, s *StateTracker, f func(filename string, p *Prayer, s *StateTracker)) {
-	s.GroupNum += 1
-	s.Group = d.Name
-	s.HailMaryNum = 0
-	i := 1
-	s.SetDecadeNumWord(1)
-	if len(d.Mysteries) > 0 {
-		s.MysteryNum = d.Mysteries[0].Num
+func (seg *Segment) ForEachFile(o OptionProvider, s *StateTracker, f func(filename string, p *Prayer, s *StateTracker)) {
+	saved := s.saveSection()
+	seg.enter(s)
+	for _, step := range seg.Steps {
+		step.ForEachFile(o, s, f)
+	}
+	for _, sub := range seg.Segments {
+		sub.ForEachFile(o, s, f)
+	}
+	s.restoreSection(saved)
+}
+
+func (step *Step) ForEachFile(o OptionProvider, s *StateTracker, f func(filename string, p *Prayer, s *StateTracker)) {
+	if !s.TestAll(step.When) {
+		return
+	}
+	if replacements, ok := step.Seasonal[s.Season()]; ok {
+		for _, r := range replacements {
+			r.ForEachFile(o, s, f)
+		}
+		return
+	}
+	step.Prayer.ForEachFile(o, s, f)
+}
 
-		s.Mystery = d.Mysteries[0].Name
-		s.MysteryPhrase = s.Mystery + " Mystery"
-	} else {
-		s.MysteryNum = 0
-		s.Mystery = ""
-		s.MysteryPhrase = ""
+// enter updates s for the start of the segment
+func (seg *Segment) enter(s *StateTracker) {
+	section := seg.Section
+	s.Section = section.Key
+	switch {
+	case section.ForEach == "group":
+		// The group's own prayers belong with its first mystery
+		s.MysteryGroupNum = seg.Num
+		s.MysteryGroupCount = seg.Count
+		s.SetDecade(1, len(seg.Mysteries))
+		if len(seg.Mysteries) > 0 {
+			s.SetMystery(seg.Mysteries[0])
+		} else {
+			s.SetMystery(nil)
+		}
+	case section.ForEach == "mystery":
+		s.SetDecade(seg.Num, seg.Count)
+		s.SetMystery(seg.Mystery)
+	case seg.Count > 0:
+		s.SetDecade(seg.Num, seg.Count)
 	}
-	for _, p := range d.Group {
-		p.ForEachFile(o, s, f)
+	if section.Name != "" || section.ForEach == "group" {
+		s.GroupNum += 1
+		if section.ForEach == "group" {
+			s.Group = seg.Group.Name
+		} else {
+			// a failure is left for Err
+			s.Group, _ = s.Apply(section.Name)
+			s.SetMystery(nil)
+			if seg.Count == 0 {
+				s.SetDecade(0, 0)
+			}
+		}
 	}
-	for _, m := range d.Mysteries {
-		s.SetDecadeNumWord(i)
-		m.ForEachFile(o, s, f)
-		i += 1
+	if section.Name != "" || section.ForEach != "" || seg.Count > 0 {
+		s.HailMaryNum = 0
+	}
+	if len(section.Vars) > 0 {
+		vars := make(map[string]string, len(s.Vars)+len(section.Vars))
+		for k, v := range s.Vars {
+			vars[k] = v
+		}
+		for _, k := range sortedKeys(section.Vars) {
+			vars[k], _ = s.Apply(section.Vars[k])
+		}
+		s.Vars = vars
 	}
-	s.MysteryNum = 0
-	s.Mystery = ""
-	s.MysteryPhrase = ""
-	s.SetDecadeNumWord(0)
 }
 
 type Mystery struct {
-	Num     int
-	Name    string
-	Desc    string
-	Prayers []*Prayer
+	Num  int
+	Name string
+	Desc string
+
+	// Scripture gives the passages telling of the mystery, Fruit the grace
+	// traditionally asked for in it, and Meditation a short reflection on it
+	Scripture  string
+	Fruit      string
+	Meditation string
+
+	// Verses are read one before each Hail Mary of the mystery's decade,
+	// by the versemeditation prayer
+	Verses []*Verse
+
+	// Lang translates Name, Desc, Fruit and Meditation (see Generator.SetLanguage)
+	Lang Localized
+}
+
+// Verse is a line of scripture, and the recording of it if Filename is set
+type Verse struct {
+	Text     string
+	Filename string
 }
 
 func NewMystery(num int, name string) *Mystery {
 	return &Mystery{
-		Num:     num,
-		Name:    name,
-		Prayers: make([]*Prayer, 0, 20),
+		Num:  num,
+		Name: name,
 	}
 }
 
@@ -160,23 +413,20 @@ func (m *Mystery) SetDesc(desc string) {
 	m.Desc = desc
 }
 
-func (m *Mystery) GetPrayers() []*Prayer {
-	s := []*Prayer{}
-	for _, p := range m.Prayers {
-		s = append(s, p)
-	}
-	return s
+func (m *Mystery) SetScripture(scripture string) {
+	m.Scripture = scripture
 }
 
-func (m *Mystery) ForEachFile(o OptionProvider, s *StateTracker, f func(filename string, p *Prayer, s *StateTracker)) {
-	s.MysteryNum = m.Num
-	s.Mystery = m.Name
-	s.MysteryPhrase = s.Mystery + " Mystery"
-	s.HailMaryNum = 0
-	for _, p := range m.Prayers {
-		p.ForEachFile(o, s, f)
-	}
-	s.HailMaryNum = 0
+func (m *Mystery) SetFruit(fruit string) {
+	m.Fruit = fruit
+}
+
+func (m *Mystery) SetMeditation(meditation string) {
+	m.Meditation = meditation
+}
+
+func (m *Mystery) AddVerse(text string, filename string) {
+	m.Verses = append(m.Verses, &Verse{Text: text, Filename: filename})
 }
 
 type Group struct {
@@ -184,6 +434,9 @@ type Group struct {
 	Key       string
 	Name      string
 	Mysteries []int
+
+	// Lang translates Name (see Generator.SetLanguage)
+	Lang Localized
 }
 
 func NewGroup(order int, key string, name string) *Group {
@@ -202,3 +455,26 @@ func (g *Group) AddMystery(mystery int) {
 func (g *Group) String() string {
 	return fmt.Sprintf("%s: %s", g.Key, g.Name)
 }
+
+// GroupSet names a list of groups said together, such as "all"
+type GroupSet struct {
+	Key    string
+	Name   string
+	Groups []string
+}
+
+func NewGroupSet(key string, name string) *GroupSet {
+	return &GroupSet{
+		Key:    key,
+		Name:   name,
+		Groups: make([]string, 0, 4),
+	}
+}
+
+func (gs *GroupSet) AddGroup(group string) {
+	gs.Groups = append(gs.Groups, group)
+}
+
+func (gs *GroupSet) String() string {
+	return fmt.Sprintf("%s: %s (%s)", gs.Key, gs.Name, strings.Join(gs.Groups, ", "))
+}
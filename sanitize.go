@@ -0,0 +1,192 @@
+package rosarygen
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// SanitizePolicies are the ways output filenames can be made safe to write
+// (see StateTracker.Sanitize):
+//
+//	strict  safe on FAT32 and on CD-ROMs (ISO9660 with Joliet): ASCII letters,
+//	        digits, spaces and - _ . only, accents dropped, at most 64 characters
+//	posix   safe on Linux and macOS: no / or control characters
+//	none    used as the template gives them
+var SanitizePolicies = []string{"strict", "posix", "none"}
+
+func IsSanitizePolicy(policy string) bool {
+	for _, p := range SanitizePolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// maxStrictLength is the longest name Joliet allows
+const maxStrictLength = 64
+
+// SanitizeFilename makes name, a single filename without its directory,
+// safe to write under policy
+func SanitizeFilename(name string, policy string) string {
+	switch policy {
+	case "none":
+		return name
+	case "strict":
+		name = sanitizeStrict(name)
+	default:
+		name = strings.Map(func(r rune) rune {
+			switch {
+			case r == '/':
+				return '-'
+			case r < ' ' || r == 0x7f:
+				return -1
+			}
+			return r
+		}, name)
+	}
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+var accentFolds = map[rune]string{
+	'À': "A", 'Á': "A", 'Â': "A", 'Ã': "A", 'Ä': "A", 'Å': "A", 'Æ': "AE", 'Ç': "C",
+	'È': "E", 'É': "E", 'Ê': "E", 'Ë': "E", 'Ì': "I", 'Í': "I", 'Î': "I", 'Ï': "I",
+	'Ñ': "N", 'Ò': "O", 'Ó': "O", 'Ô': "O", 'Õ': "O", 'Ö': "O", 'Ø': "O", 'Ù': "U",
+	'Ú': "U", 'Û': "U", 'Ü': "U", 'Ý': "Y", 'ß': "ss", 'à': "a", 'á': "a", 'â': "a",
+	'ã': "a", 'ä': "a", 'å': "a", 'æ': "ae", 'ç': "c", 'è': "e", 'é': "e", 'ê': "e",
+	'ë': "e", 'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ñ': "n", 'ò': "o", 'ó': "o",
+	'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ù': "u", 'ú': "u", 'û': "u", 'ü': "u",
+	'ý': "y", 'ÿ': "y", 'Œ': "OE", 'œ': "oe",
+}
+
+// windowsReserved are names FAT32 cannot hold whatever their extension
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+func sanitizeStrict(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == ' ', r == '-', r == '_', r == '.':
+			b.WriteRune(r)
+		case accentFolds[r] != "":
+			b.WriteString(accentFolds[r])
+		case r == '/' || r == '\\' || r == ':' || r == '|':
+			b.WriteRune('-')
+		}
+	}
+	// collapse the spaces left by dropped characters, and
+	// trim the spaces and dots FAT32 drops from the ends
+	name = strings.Join(strings.Fields(b.String()), " ")
+	if len(name) > maxStrictLength {
+		name = name[:maxStrictLength]
+	}
+	name = strings.Trim(name, " .")
+	if windowsReserved[strings.ToUpper(name)] {
+		name += "_"
+	}
+	return name
+}
+
+// pathMark stands in for each / written in the output filename template
+// itself, so that those can be told from a / in a field value, such as the
+// prayer name "Salve Regina/Hail Holy Queen"
+const pathMark = "\x00"
+
+// markSeparators returns template with each / outside its actions
+// replaced by pathMark
+func markSeparators(template string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(template, "{{")
+		if i < 0 {
+			b.WriteString(strings.ReplaceAll(template, "/", pathMark))
+			return b.String()
+		}
+		b.WriteString(strings.ReplaceAll(template[:i], "/", pathMark))
+		j := strings.Index(template[i:], "}}")
+		if j < 0 {
+			b.WriteString(template[i:])
+			return b.String()
+		}
+		b.WriteString(template[i : i+j+2])
+		template = template[i+j+2:]
+	}
+}
+
+// sanitizePath splits name, as applied from the template markSeparators
+// gives, at each pathMark and sanitizes each part by policy, so that a / in
+// the template makes a subdirectory while one in a value is replaced. It
+// returns the directory and the filename.
+func sanitizePath(name string, policy string) (string, string) {
+	if policy == "none" {
+		return filepath.Split(name)
+	}
+	var parts []string
+	for _, part := range strings.Split(name, pathMark) {
+		if part != "" {
+			parts = append(parts, SanitizeFilename(part, policy))
+		}
+	}
+	if len(parts) == 0 {
+		return "", SanitizeFilename("", policy)
+	}
+	return filepath.Join(parts[:len(parts)-1]...), parts[len(parts)-1]
+}
+
+// numbered returns name with n added, cut under the strict policy to
+// keep within maxStrictLength
+func numbered(name string, n int, policy string) string {
+	suffix := fmt.Sprintf(" %v", n)
+	if policy == "strict" && len(name)+len(suffix) > maxStrictLength {
+		name = strings.TrimRight(name[:maxStrictLength-len(suffix)], " .")
+	}
+	return name + suffix
+}
+
+// outputPath returns the file to write for output, the full path as the
+// template gives it, sanitized by the Sanitize policy. Two different outputs
+// coming to the same file are kept apart by numbering the later one,
+// e.g. "Oh Mary 2.wav", with a warning.
+func (s *StateTracker) outputPath(output string, dir string, name string, ext string) string {
+	if s.outputs == nil {
+		s.outputs = map[string]string{}
+		s.claimed = map[string]string{}
+	}
+	if path, ok := s.outputs[output]; ok {
+		return path
+	}
+	subdir, name := sanitizePath(name, s.Sanitize)
+	dir = filepath.Join(dir, subdir)
+	path := filepath.Join(dir, name+ext)
+	for n := 2; ; n++ {
+		other, ok := s.claimed[s.collisionKey(path)]
+		if !ok {
+			break
+		}
+		if n == 2 {
+			log.Printf("Output '%v' would be written to %v, as '%v' is; numbering it", output, path, other)
+		}
+		path = filepath.Join(dir, numbered(name, n, s.Sanitize)+ext)
+	}
+	s.outputs[output] = path
+	s.claimed[s.collisionKey(path)] = output
+	return path
+}
+
+// collisionKey is the name path is known by on disk, which under the
+// strict policy is case-insensitive, as on FAT32
+func (s *StateTracker) collisionKey(path string) string {
+	if s.Sanitize == "strict" {
+		return strings.ToLower(path)
+	}
+	return path
+}
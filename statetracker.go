@@ -4,12 +4,13 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"log"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 )
 
 type StateTracker struct {
@@ -18,12 +19,21 @@ type StateTracker struct {
 	Format    string
 
 	Group         string // Preamble/[Group]/Postamble
+	Section       string // key of the structure section being said, e.g. "preamble" or "mystery"
 	DecadeNumWord string
 	Mystery       string
 	MysteryPhrase string
 	Prayer        string
 	PrayerName    string
 
+	// MysteryDesc, Fruit, Scripture and Meditation describe the mystery
+	// being said (see Mystery). MysteryDesc is its Name if it has no Desc.
+	MysteryDesc string
+	Fruit       string
+	Scripture   string
+	Meditation  string
+	verses      []*Verse
+
 	OutputFileNum int
 	InputFileNum  int
 	GroupNum      int
@@ -31,6 +41,53 @@ type StateTracker struct {
 	PrayerNum     int
 	HailMaryNum   int
 
+	// DecadeNum counts passes through a repeated section, such as the
+	// mysteries of a group, from 1 to DecadeCount
+	DecadeNum   int
+	DecadeCount int
+
+	// MysteryGroupNum counts the groups of mysteries said,
+	// from 1 to MysteryGroupCount
+	MysteryGroupNum   int
+	MysteryGroupCount int
+
+	// Date is the day the rosary is said, for conditions such as
+	// {{eq .Weekday "Saturday"}}
+	Date time.Time
+
+	// Vars holds the variables set by the sections being said
+	Vars map[string]string
+
+	// Seed makes the choice of takes reproducible, see SetSeed and ChooseTake
+	Seed  int64
+	rand  *rand.Rand
+	said  map[string]int
+	decks map[string]*takeDeck
+
+	// TakePolicy, if set, makes MatchActualFile look for numbered takes of
+	// every file, choosing between them by the policy. A prayer's own policy
+	// is used in its place for that prayer.
+	TakePolicy string
+	filePolicy string
+	foundTakes map[string][]string
+
+	// Language, if set, gives the words of NumWord, CountWord,
+	// XthGroupMystery and XofGroup
+	Language *Language
+
+	// Sanitize is the policy making output filenames safe to write,
+	// one of SanitizePolicies
+	Sanitize   string
+	lastOutput string
+	outputs    map[string]string
+	claimed    map[string]string
+
+	// templates are compiled once, by Compile or on first use,
+	// and errs collects the errors of templates that failed in Apply
+	templates map[string]*template.Template
+	errs      ErrorList
+	failed    map[string]bool
+
 	OutputFilenameTemplate string
 	LastFilename           string
 }
@@ -49,43 +106,196 @@ func NewStateTracker(idirs []string, odir string, outputFilename string, format
 
 		OutputFileNum: 0,
 		InputFileNum:  0,
-		GroupNum:      1,
+		GroupNum:      0,
 		MysteryNum:    0,
 		PrayerNum:     0,
 		HailMaryNum:   0,
 
+		DecadeNum:   0,
+		DecadeCount: 0,
+
+		MysteryGroupNum:   0,
+		MysteryGroupCount: 0,
+
+		Date: time.Now(),
+		Vars: map[string]string{},
+
+		Seed: 1,
+		said: map[string]int{},
+
+		Sanitize: "posix",
+
 		OutputFilenameTemplate: outputFilename,
 		LastFilename:           "",
 	}
 
 }
 
-func (s *StateTracker) UpdateFilename() (filenameChanged bool) {
-	temp := filepath.Join(s.OutputDir, s.Apply(s.OutputFilenameTemplate)+"."+s.Format)
-	if temp != s.LastFilename {
+// UpdateFilename moves LastFilename on to the next output file if the
+// output filename template now gives a different name, sanitized by
+// the Sanitize policy. It fails, leaving LastFilename as it was, if the
+// template does.
+func (s *StateTracker) UpdateFilename() (filenameChanged bool, err error) {
+	name, err := s.Apply(s.outputTemplate())
+	if err != nil {
+		return false, err
+	}
+	temp := filepath.Join(s.OutputDir, strings.ReplaceAll(name, pathMark, "/")+"."+s.Format)
+	if temp != s.lastOutput {
 		s.OutputFileNum += 1
-		s.LastFilename = filepath.Join(s.OutputDir, s.Apply(s.OutputFilenameTemplate)+"."+s.Format)
-		return true
+		// applied again, as the template may use the new file number
+		name, err = s.Apply(s.outputTemplate())
+		if err != nil {
+			return false, err
+		}
+		s.lastOutput = filepath.Join(s.OutputDir, strings.ReplaceAll(name, pathMark, "/")+"."+s.Format)
+		s.LastFilename = s.outputPath(s.lastOutput, s.OutputDir, name, "."+s.Format)
+		return true, nil
 	}
-	return false
+	return false, nil
 
 }
 
-func (s *StateTracker) Apply(name string) string {
-	if strings.Contains(name, "{{") {
+// outputTemplate is the output filename template, with the separators it
+// writes marked for sanitizing apart from those in its values
+func (s *StateTracker) outputTemplate() string {
+	if s.Sanitize == "none" {
+		return s.OutputFilenameTemplate
+	}
+	return markSeparators(s.OutputFilenameTemplate)
+}
+
+// Apply executes the template name against s. Templates are compiled once
+// and kept (see Compile). The error of a template that fails is also kept
+// for Err, once for each template, so that callers with no way to return
+// it, such as conditions, can leave it to be found there; Rosary.Compile
+// finds most of them before rendering starts.
+func (s *StateTracker) Apply(name string) (string, error) {
+	if !strings.Contains(name, "{{") {
+		return name, nil
+	}
+	t, err := s.compiled(name)
+	if err == nil {
 		var out bytes.Buffer
-		t := template.Must(template.New(".").Parse(name))
-		if err := t.Execute(&out, s); err != nil {
-			log.Fatalf("Error '%v' parsing template '%v'", err, name)
+		if err = t.Execute(&out, s); err == nil {
+			return out.String(), nil
+		}
+	}
+	// reported as written, without the marks of outputTemplate
+	err = fmt.Errorf("template '%v': %v", strings.ReplaceAll(name, pathMark, "/"), err)
+	if !s.failed[name] {
+		// a failing template usually fails again for every file, keep it once
+		if s.failed == nil {
+			s.failed = map[string]bool{}
 		}
-		return out.String()
-	} else {
-		return name
+		s.failed[name] = true
+		s.errs.Add(err)
+	}
+	return "", err
+}
+
+// Err returns the errors of every template that failed in Apply
+func (s *StateTracker) Err() error {
+	return s.errs.Err()
+}
+
+// Compile compiles the template name into the templates kept by s,
+// checking it as CheckTemplate does
+func (s *StateTracker) Compile(name string) error {
+	if !strings.Contains(name, "{{") {
+		return nil
+	}
+	_, err := s.compiled(name)
+	return err
+}
+
+func (s *StateTracker) compiled(name string) (*template.Template, error) {
+	if t, ok := s.templates[name]; ok {
+		return t, nil
+	}
+	t, err := compileTemplate(name)
+	if err != nil {
+		return nil, err
+	}
+	if s.templates == nil {
+		s.templates = map[string]*template.Template{}
+	}
+	s.templates[name] = t
+	return t, nil
+}
+
+// Test applies the template when and reports whether the result is true:
+// anything other than blank, "false", "0" or "<no value>". A template that
+// fails is false, and its error is left for Err.
+func (s *StateTracker) Test(when string) bool {
+	result, _ := s.Apply(when)
+	switch strings.TrimSpace(result) {
+	case "", "false", "0", "<no value>":
+		return false
+	default:
+		return true
+	}
+}
+
+// TestAll reports whether every template of when is true (see Test)
+func (s *StateTracker) TestAll(when []string) bool {
+	for _, w := range when {
+		if !s.Test(w) {
+			return false
+		}
+	}
+	return true
+}
+
+// Season is the liturgical season of Date, one of Seasons, e.g. "eastertide"
+func (s *StateTracker) Season() string {
+	return Season(s.Date)
+}
+
+// Weekday is the name of the day of the week of Date, e.g. "Saturday"
+func (s *StateTracker) Weekday() string {
+	return s.Date.Weekday().String()
+}
+
+// IsLastDecade reports whether the last mystery of the last group,
+// or the last pass through a repeated section, is being said
+func (s *StateTracker) IsLastDecade() bool {
+	return s.MysteryGroupNum == s.MysteryGroupCount && s.DecadeNum > 0 && s.DecadeNum == s.DecadeCount
+}
+
+// VerseNum is the number of the verse for the coming Hail Mary of the mystery,
+// one more than the Hail Marys said so far
+func (s *StateTracker) VerseNum() int {
+	return s.HailMaryNum + 1
+}
+
+// Verse is the text of verse VerseNum of the current mystery, or "" if it has no such verse
+func (s *StateTracker) Verse() string {
+	if n := s.VerseNum(); n <= len(s.verses) {
+		return s.verses[n-1].Text
 	}
+	return ""
 }
 
-// Searches input dirs in order specified for the file
+// VerseFile is the recording of verse VerseNum of the current mystery,
+// by default Verse{{.Mystery}}{{.VerseNum}}, e.g. VerseAgony3
+func (s *StateTracker) VerseFile() string {
+	n := s.VerseNum()
+	if n <= len(s.verses) && s.verses[n-1].Filename != "" {
+		return s.verses[n-1].Filename
+	}
+	return "Verse" + s.Mystery + strconv.Itoa(n)
+}
+
+// Searches input dirs in order specified for the file.
+// While a prayer with a take policy is being said (see TakePolicy),
+// numbered takes of the file are used in its place if any are found.
 func (s *StateTracker) MatchActualFile(filename string) (string, error) {
+	if s.filePolicy != "" {
+		if takes := s.FindTakes(filename); len(takes) > 0 {
+			return takes[s.chooseTake(s.Prayer, filename, s.filePolicy, len(takes))], nil
+		}
+	}
 	fname := filename + "." + s.Format
 	for _, p := range s.InputDirs {
 		t := filepath.Join(p, fname)
@@ -97,6 +307,11 @@ func (s *StateTracker) MatchActualFile(filename string) (string, error) {
 }
 
 func (s *StateTracker) NumWord(num int) string {
+	if s.Language != nil {
+		if w, ok := s.Language.Ordinal(num); ok {
+			return w
+		}
+	}
 	switch num {
 	case 0:
 		return ""
@@ -125,32 +340,180 @@ func (s *StateTracker) NumWord(num int) string {
 	}
 }
 
+// StandaloneNumWord is NumWord for an ordinal with no noun after it,
+// as in XofGroup, for languages shortening ordinals before a noun
+func (s *StateTracker) StandaloneNumWord(num int) string {
+	if s.Language != nil {
+		if w, ok := s.Language.StandaloneOrdinal(num); ok {
+			return w
+		}
+	}
+	return s.NumWord(num)
+}
+
+// CountWord is the cardinal counterpart of NumWord: "One", "Two", etc
+func (s *StateTracker) CountWord(num int) string {
+	if s.Language != nil {
+		if w, ok := s.Language.Count(num); ok {
+			return w
+		}
+	}
+	switch num {
+	case 0:
+		return "Zero"
+	case 1:
+		return "One"
+	case 2:
+		return "Two"
+	case 3:
+		return "Three"
+	case 4:
+		return "Four"
+	case 5:
+		return "Five"
+	case 6:
+		return "Six"
+	case 7:
+		return "Seven"
+	case 8:
+		return "Eight"
+	case 9:
+		return "Nine"
+	case 10:
+		return "Ten"
+	default:
+		return strconv.Itoa(num)
+	}
+}
+
 func (s *StateTracker) SetDecadeNumWord(num int) {
 	s.DecadeNumWord = s.NumWord(num)
 }
 
+func (s *StateTracker) SetDecade(num int, count int) {
+	s.DecadeNum = num
+	s.DecadeCount = count
+	s.SetDecadeNumWord(num)
+}
+
+// SetMystery sets the Mystery fields for m, or clears them if m is nil
+func (s *StateTracker) SetMystery(m *Mystery) {
+	if m == nil {
+		s.MysteryNum = 0
+		s.Mystery = ""
+		s.MysteryPhrase = ""
+		s.MysteryDesc = ""
+		s.Fruit = ""
+		s.Scripture = ""
+		s.Meditation = ""
+		s.verses = nil
+		return
+	}
+	s.MysteryNum = m.Num
+	s.Mystery = m.Name
+	s.MysteryPhrase = s.Mystery + " Mystery"
+	s.MysteryDesc = firstNonEmpty(m.Desc, m.Name)
+	s.Fruit = m.Fruit
+	s.Scripture = m.Scripture
+	s.Meditation = m.Meditation
+	s.verses = m.Verses
+}
+
+// sectionState holds the fields a Segment sets, to be put back when it ends
+type sectionState struct {
+	group         string
+	section       string
+	decadeNumWord string
+	decadeNum     int
+	decadeCount   int
+	mysteryNum    int
+	mystery       string
+	mysteryPhrase string
+	mysteryDesc   string
+	fruit         string
+	scripture     string
+	meditation    string
+	verses        []*Verse
+	hailMaryNum   int
+	vars          map[string]string
+}
+
+func (s *StateTracker) saveSection() sectionState {
+	return sectionState{
+		group:         s.Group,
+		section:       s.Section,
+		decadeNumWord: s.DecadeNumWord,
+		decadeNum:     s.DecadeNum,
+		decadeCount:   s.DecadeCount,
+		mysteryNum:    s.MysteryNum,
+		mystery:       s.Mystery,
+		mysteryPhrase: s.MysteryPhrase,
+		mysteryDesc:   s.MysteryDesc,
+		fruit:         s.Fruit,
+		scripture:     s.Scripture,
+		meditation:    s.Meditation,
+		verses:        s.verses,
+		hailMaryNum:   s.HailMaryNum,
+		vars:          s.Vars,
+	}
+}
+
+func (s *StateTracker) restoreSection(saved sectionState) {
+	s.Group = saved.group
+	s.Section = saved.section
+	s.DecadeNumWord = saved.decadeNumWord
+	s.DecadeNum = saved.decadeNum
+	s.DecadeCount = saved.decadeCount
+	s.MysteryNum = saved.mysteryNum
+	s.Mystery = saved.mystery
+	s.MysteryPhrase = saved.mysteryPhrase
+	s.MysteryDesc = saved.mysteryDesc
+	s.Fruit = saved.fruit
+	s.Scripture = saved.scripture
+	s.Meditation = saved.meditation
+	s.verses = saved.verses
+	s.HailMaryNum = saved.hailMaryNum
+	s.Vars = saved.vars
+}
+
 func (s *StateTracker) XthGroupMystery() string {
 	switch s.Group {
-	case "Preamble":
-		return "Preamble"
-	case "Postamble":
-		return "Postamble"
+	case "Preamble", "Postamble":
+		return s.section()
 	default:
+		if s.Language != nil && s.Language.XthGroupMystery != "" {
+			// a failure is left for Err
+			result, _ := s.Apply(s.Language.XthGroupMystery)
+			return result
+		}
 		return s.DecadeNumWord + " " + s.Group + " Mystery"
 	}
 }
 
 func (s *StateTracker) XofGroup() string {
 	switch s.Group {
-	case "Preamble":
-		return "Preamble"
-	case "Postamble":
-		return "Postamble"
+	case "Preamble", "Postamble":
+		return s.section()
 	default:
+		if s.Language != nil && s.Language.XofGroup != "" {
+			// a failure is left for Err
+			result, _ := s.Apply(s.Language.XofGroup)
+			return result
+		}
 		return s.DecadeNumWord + " Of " + s.Group
 	}
 }
 
+// section names the Preamble or Postamble group in the Language
+func (s *StateTracker) section() string {
+	if s.Language != nil {
+		if word, ok := s.Language.Section(s.Group); ok {
+			return word
+		}
+	}
+	return s.Group
+}
+
 func (s *StateTracker) FileNum() int {
 	return s.OutputFileNum
 }
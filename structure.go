@@ -1,63 +1,509 @@
 package rosarygen
 
-import "strings"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
+// Structure describes the order of prayers in a rosary or chaplet
+// as a tree of Sections. The preamble, group, mystery and postamble
+// lists of structures.toml map onto the tree
+//
+//	preamble
+//	group      - once for each group of mysteries
+//	    mystery - once for each mystery of the group
+//	postamble
 type Structure struct {
-	Key       string
-	Name      string
-	Preamble  []string
-	Group     []string
-	Mystery   []string
-	Postamble []string
+	Key      string
+	Name     string
+	Sections []*Section
+
+	// When holds conditions for prayers by prayer key, added to
+	// each entry for that prayer
+	When map[string]string
+
+	// Options are used over the global options while the structure is said
+	Options *Options
+
+	// Seasonal holds prayers said in place of others during a liturgical
+	// season, by season and then by the key of the prayer replaced
+	Seasonal map[string]map[string][]Entry
+
+	// Extends names the structure this one is derived from,
+	// with Edits describing how it differs. See ResolveStructures.
+	Extends  string
+	Edits    *StructureEdits
+	resolved bool
+	expanded bool
+}
+
+// Section is one node of a Structure: a list of prayers, followed by any subsections.
+//
+// A Section with a Name starts a new group, as the preamble and postamble do;
+// the Name may use template fields. A Section with ForEach set is said once for
+// each group of mysteries ("group"), or once for each mystery of the current group
+// ("mystery"), and one with a Repeat count is said that many times. Each time
+// through either sets DecadeNum and DecadeNumWord. Vars are templates whose
+// results are available as {{.Vars.name}} while the Section is being said.
+type Section struct {
+	Key      string
+	Name     string
+	ForEach  string
+	Repeat   int
+	Vars     map[string]string
+	Entries  []Entry
+	Sections []*Section
 }
 
+// Entry is one prayer in a Section. It is only said if each of its When
+// templates is true when it is reached (see StateTracker.Test).
+type Entry struct {
+	Prayer string
+	When   []string
+}
+
+// StructureEdits describes how a structure differs from the one it extends.
+// Prayers, Prepend and Append are keyed by section key ("preamble", "mystery", etc),
+// Replace, InsertBefore and InsertAfter by prayer key.
+type StructureEdits struct {
+	Sections     []*Section         // the whole tree given outright, nil keeps the parent's
+	Prayers      map[string][]Entry // a section's prayers given outright, replacing the parent's
+	Replace      map[string][]Entry // an empty replacement removes the prayer
+	InsertBefore map[string][]Entry
+	InsertAfter  map[string][]Entry
+	Prepend      map[string][]Entry
+	Append       map[string][]Entry
+	Repeat       *int // nil keeps the parent's repeat
+}
+
+// SectionNames lists the sections of the original structure format in the order they are said
+var SectionNames = []string{"preamble", "group", "mystery", "postamble"}
+
+// NewStructure creates a Structure with the four empty sections of the original format
 func NewStructure(key string, name string) *Structure {
+	group := NewSection("group", "")
+	group.ForEach = "group"
+	mystery := NewSection("mystery", "")
+	mystery.ForEach = "mystery"
+	group.AddSection(mystery)
 	return &Structure{
-		Key:       key,
-		Name:      name,
-		Preamble:  make([]string, 0, 10),
-		Group:     make([]string, 0, 10),
-		Mystery:   make([]string, 0, 20),
-		Postamble: make([]string, 0, 10),
+		Key:      key,
+		Name:     name,
+		When:     map[string]string{},
+		Options:  NewOptions(),
+		Seasonal: map[string]map[string][]Entry{},
+		Sections: []*Section{
+			NewSection("preamble", "Preamble"),
+			group,
+			NewSection("postamble", "Postamble"),
+		},
 	}
 }
 
-func StructureForPrayer(prayer string) *Structure {
-	return &Structure{
-		Key:       prayer,
-		Name:      prayer,
-		Preamble:  []string{prayer},
-		Group:     []string{},
-		Mystery:   []string{},
-		Postamble: []string{},
+func NewSection(key string, name string) *Section {
+	return &Section{
+		Key:      key,
+		Name:     name,
+		Vars:     map[string]string{},
+		Entries:  make([]Entry, 0, 10),
+		Sections: []*Section{},
+	}
+}
+
+func NewStructureEdits() *StructureEdits {
+	return &StructureEdits{
+		Prayers:      map[string][]Entry{},
+		Replace:      map[string][]Entry{},
+		InsertBefore: map[string][]Entry{},
+		InsertAfter:  map[string][]Entry{},
+		Prepend:      map[string][]Entry{},
+		Append:       map[string][]Entry{},
 	}
 }
 
+func StructureForPrayer(prayer string) *Structure {
+	s := NewStructure(prayer, prayer)
+	s.AddPreamble(prayer)
+	return s
+}
+
 func StructureForPrayers(prayers string) *Structure {
 	ps := strings.Split(prayers, ",")
-	return &Structure{
-		Key:       ps[0],
-		Name:      ps[0],
-		Preamble:  ps,
-		Group:     []string{},
-		Mystery:   []string{},
-		Postamble: []string{},
+	s := NewStructure(ps[0], ps[0])
+	for _, p := range ps {
+		s.AddPreamble(p)
+	}
+	return s
+}
+
+func (s *Section) AddPrayer(prayer string) {
+	s.AddEntry(Entry{Prayer: prayer})
+}
+
+func (s *Section) AddEntry(entry Entry) {
+	s.Entries = append(s.Entries, entry)
+}
+
+func (s *Section) AddSection(section *Section) {
+	s.Sections = append(s.Sections, section)
+}
+
+func (s *Section) SetVar(name string, value string) {
+	s.Vars[name] = value
+}
+
+// Copy returns a deep copy of the Section and its subsections
+func (s *Section) Copy() *Section {
+	c := *s
+	c.Vars = map[string]string{}
+	for k, v := range s.Vars {
+		c.Vars[k] = v
+	}
+	c.Entries = append([]Entry{}, s.Entries...)
+	c.Sections = copySections(s.Sections)
+	return &c
+}
+
+func copySections(sections []*Section) []*Section {
+	r := make([]*Section, len(sections))
+	for i, s := range sections {
+		r[i] = s.Copy()
+	}
+	return r
+}
+
+// Walk calls f for the Section and each of its subsections, in the order they are said
+func (s *Section) Walk(f func(section *Section)) {
+	f(s)
+	for _, sub := range s.Sections {
+		sub.Walk(f)
+	}
+}
+
+// Walk calls f for each Section of the Structure, in the order they are said
+func (s *Structure) Walk(f func(section *Section)) {
+	for _, section := range s.Sections {
+		section.Walk(f)
 	}
+}
+
+// SaysGroups reports whether any section is said once for each group, so that
+// the groups given matter. Repeating chaplets say none.
+func (s *Structure) SaysGroups() bool {
+	says := false
+	s.Walk(func(section *Section) {
+		says = says || section.ForEach == "group"
+	})
+	return says
+}
+
+// Section returns the first section with the given key, or nil if there is none
+func (s *Structure) Section(key string) *Section {
+	var found *Section
+	s.Walk(func(section *Section) {
+		if found == nil && section.Key == key {
+			found = section
+		}
+	})
+	return found
+}
 
+func (s *Structure) addEntry(key string, entry Entry) {
+	if section := s.Section(key); section != nil {
+		section.AddEntry(entry)
+	}
 }
 
 func (s *Structure) AddPreamble(preamble string) {
-	s.Preamble = append(s.Preamble, preamble)
+	s.addEntry("preamble", Entry{Prayer: preamble})
 }
 
 func (s *Structure) AddGroup(group string) {
-	s.Group = append(s.Group, group)
+	s.addEntry("group", Entry{Prayer: group})
 }
 
 func (s *Structure) AddMystery(mystery string) {
-	s.Mystery = append(s.Mystery, mystery)
+	s.addEntry("mystery", Entry{Prayer: mystery})
 }
 
 func (s *Structure) AddPostamble(postamble string) {
-	s.Postamble = append(s.Postamble, postamble)
+	s.addEntry("postamble", Entry{Prayer: postamble})
+}
+
+// SetWhen makes every entry for prayer conditional on when
+func (s *Structure) SetWhen(prayer string, when string) {
+	s.When[prayer] = when
+}
+
+// SetSeasonal says replacement in place of prayer during season
+func (s *Structure) SetSeasonal(season string, prayer string, replacement []Entry) {
+	if s.Seasonal[season] == nil {
+		s.Seasonal[season] = map[string][]Entry{}
+	}
+	s.Seasonal[season][prayer] = replacement
+}
+
+// SetRepeat makes the group and mystery sections say the mystery section
+// repeat times in place of once per mystery of each group, for chaplets.
+// The group section is named for the count ("Five"). A repeat of 0
+// goes back to once per mystery.
+func (s *Structure) SetRepeat(repeat int) error {
+	group, mystery := s.Section("group"), s.Section("mystery")
+	if group == nil || mystery == nil {
+		return fmt.Errorf("structure '%v': repeat needs both a group and a mystery section", s.Key)
+	}
+	if repeat > 0 {
+		group.ForEach = ""
+		group.Name = "{{.CountWord " + strconv.Itoa(repeat) + "}}"
+		mystery.ForEach = ""
+		mystery.Repeat = repeat
+	} else {
+		group.ForEach = "group"
+		group.Name = ""
+		mystery.ForEach = "mystery"
+		mystery.Repeat = 0
+	}
+	return nil
+}
+
+// SetExtends marks the structure as derived from parent, returning the
+// Edits to fill in
+func (s *Structure) SetExtends(parent string) *StructureEdits {
+	s.Extends = parent
+	if s.Edits == nil {
+		s.Edits = NewStructureEdits()
+	}
+	return s.Edits
+}
+
+// ResolveStructures expands repeats and block references in each
+// structure (see ExpandPrayers), and fills in each structure that
+// extends another from its parent and Edits. It must be called
+// once every file has been parsed and merged, since a structure may
+// extend a structure or use a block defined in a different file.
+//
+// The parent's sections are copied unless the whole tree is given
+// outright, then any sections given outright replace the parent's prayers,
+// prayers are replaced, insertions made around each occurrence of
+// a prayer, and finally prayers are prepended and appended to sections.
+// Each structure's When conditions are then added to its entries, and its
+// Options and Seasonal replacements are layered over its parent's.
+func ResolveStructures(structures map[string]*Structure, blocks map[string][]Entry) error {
+	var errs ErrorList
+	for _, k := range sortedKeys(structures) {
+		errs.Add(structures[k].expand(blocks))
+	}
+	for _, k := range sortedKeys(structures) {
+		errs.Add(resolveStructure(structures, structures[k], nil))
+	}
+	return errs.Err()
+}
+
+func resolveStructure(structures map[string]*Structure, s *Structure, chain []string) error {
+	if s.resolved {
+		return nil
+	}
+	if s.Extends == "" {
+		s.resolved = true
+		s.applyWhen()
+		return nil
+	}
+	chain = append(chain, s.Key)
+	for _, k := range chain[:len(chain)-1] {
+		if k == s.Key {
+			return fmt.Errorf("structure '%v': structures extend each other in a loop (%v)", s.Key, strings.Join(chain, " -> "))
+		}
+	}
+	parent, ok := structures[s.Extends]
+	if !ok {
+		s.resolved = true
+		return fmt.Errorf("structure '%v': extends unknown structure '%v'", s.Key, s.Extends)
+	}
+	if err := resolveStructure(structures, parent, chain); err != nil {
+		s.resolved = true
+		return err
+	}
+	err := s.derive(parent)
+	s.applyWhen()
+	return err
+}
+
+func (s *Structure) applyWhen() {
+	if len(s.When) == 0 {
+		return
+	}
+	s.Walk(func(section *Section) {
+		for i, e := range section.Entries {
+			if when, ok := s.When[e.Prayer]; ok {
+				section.Entries[i] = e.And(when)
+			}
+		}
+	})
+}
+
+// And returns a copy of e that is only said if when is also true
+func (e Entry) And(when ...string) Entry {
+	e.When = append(e.When[:len(e.When):len(e.When)], when...)
+	return e
+}
+
+// expand applies ExpandPrayers to every list of prayers in the structure
+func (s *Structure) expand(blocks map[string][]Entry) error {
+	if s.expanded {
+		return nil
+	}
+	s.expanded = true
+	var errs ErrorList
+	expand := func(where string, list []Entry) []Entry {
+		r, err := ExpandPrayers(list, blocks)
+		if el, ok := err.(ErrorList); ok {
+			for _, e := range el {
+				errs.Add(fmt.Errorf("structure '%v' %v: %v", s.Key, where, e))
+			}
+		}
+		return r
+	}
+	expandAll := func(what string, m map[string][]Entry) {
+		for _, k := range sortedKeys(m) {
+			m[k] = expand(what+" "+k, m[k])
+		}
+	}
+	s.Walk(func(section *Section) {
+		section.Entries = expand(section.Key, section.Entries)
+	})
+	for _, season := range sortedKeys(s.Seasonal) {
+		expandAll("seasonal "+season, s.Seasonal[season])
+	}
+	if s.Edits != nil {
+		expandAll("section", s.Edits.Prayers)
+		expandAll("replace", s.Edits.Replace)
+		expandAll("insert_before", s.Edits.InsertBefore)
+		expandAll("insert_after", s.Edits.InsertAfter)
+		expandAll("prepend", s.Edits.Prepend)
+		expandAll("append", s.Edits.Append)
+	}
+	return errs.Err()
+}
+
+// ExpandPrayers expands a list of prayers as written in a structure into
+// the flat list of prayer keys that will be said. An entry may repeat a
+// prayer ("hailmary*10"), refer to a named block of prayers ("@decade"),
+// or repeat a block ("@decade*5"). Blocks may themselves use either form.
+// Entries from a block keep their own conditions as well as the reference's.
+func ExpandPrayers(list []Entry, blocks map[string][]Entry) ([]Entry, error) {
+	return expandPrayers(list, blocks, nil)
+}
+
+func expandPrayers(list []Entry, blocks map[string][]Entry, chain []string) ([]Entry, error) {
+	var errs ErrorList
+	r := make([]Entry, 0, len(list))
+	for _, entry := range list {
+		name := strings.TrimSpace(entry.Prayer)
+		count := 1
+		if i := strings.LastIndex(name, "*"); i >= 0 {
+			n, err := strconv.Atoi(strings.TrimSpace(name[i+1:]))
+			if err != nil || n < 0 {
+				errs.Add(fmt.Errorf("'%v': repeat count must be a whole number", entry.Prayer))
+				continue
+			}
+			name = strings.TrimSpace(name[:i])
+			count = n
+		}
+		items := []Entry{{Prayer: name, When: entry.When}}
+		if strings.HasPrefix(name, "@") {
+			block := name[1:]
+			content, ok := blocks[block]
+			if !ok {
+				errs.Add(fmt.Errorf("unknown block '%v'", block))
+				continue
+			}
+			loop := false
+			for _, b := range chain {
+				loop = loop || b == block
+			}
+			if loop {
+				errs.Add(fmt.Errorf("block '%v' refers to itself (@%v -> @%v)", block, strings.Join(chain, " -> @"), block))
+				continue
+			}
+			expanded, err := expandPrayers(content, blocks, append(chain[:len(chain):len(chain)], block))
+			if err != nil {
+				errs.Add(err)
+				continue
+			}
+			items = make([]Entry, len(expanded))
+			for i, e := range expanded {
+				items[i] = e.And(entry.When...)
+			}
+		}
+		for i := 0; i < count; i++ {
+			r = append(r, items...)
+		}
+	}
+	return r, errs.Err()
+}
+
+func (s *Structure) derive(parent *Structure) error {
+	var errs ErrorList
+	s.resolved = true
+	if s.Name == "" {
+		s.Name = parent.Name
+	}
+	e := s.Edits
+	if e.Sections != nil {
+		s.Sections = e.Sections
+	} else {
+		s.Sections = copySections(parent.Sections)
+	}
+	if e.Repeat != nil {
+		errs.Add(s.SetRepeat(*e.Repeat))
+	}
+	options := NewOptions()
+	options.Merge(parent.Options)
+	options.Merge(s.Options)
+	s.Options = options
+	own := s.Seasonal
+	s.Seasonal = map[string]map[string][]Entry{}
+	for _, seasonal := range []map[string]map[string][]Entry{parent.Seasonal, own} {
+		for season, replacements := range seasonal {
+			for k, v := range replacements {
+				s.SetSeasonal(season, k, v)
+			}
+		}
+	}
+	for _, edits := range []map[string][]Entry{e.Prayers, e.Prepend, e.Append} {
+		for _, k := range sortedKeys(edits) {
+			if s.Section(k) == nil {
+				errs.Add(fmt.Errorf("structure '%v': no section '%v' in structure '%v'", s.Key, k, parent.Key))
+			}
+		}
+	}
+
+	s.Walk(func(section *Section) {
+		if own, ok := e.Prayers[section.Key]; ok {
+			section.Entries = append([]Entry{}, own...)
+		}
+
+		edited := make([]Entry, 0, len(section.Entries))
+		for _, entry := range section.Entries {
+			replacement, ok := e.Replace[entry.Prayer]
+			if !ok {
+				replacement = []Entry{entry}
+			} else {
+				replaced := make([]Entry, len(replacement))
+				for i, r := range replacement {
+					replaced[i] = r.And(entry.When...)
+				}
+				replacement = replaced
+			}
+			for _, r := range replacement {
+				edited = append(edited, e.InsertBefore[r.Prayer]...)
+				edited = append(edited, r)
+				edited = append(edited, e.InsertAfter[r.Prayer]...)
+			}
+		}
+
+		section.Entries = append(append(append([]Entry{}, e.Prepend[section.Key]...), edited...), e.Append[section.Key]...)
+	})
+	return errs.Err()
 }
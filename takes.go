@@ -0,0 +1,157 @@
+package rosarygen
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TakePolicies lists the ways of choosing among a prayer's takes
+//
+//	roundrobin - each take in turn, counting by HailMaryNum for the Hail Mary
+//	             and by the times the prayer has been said for any other
+//	random     - any take, chosen at random
+//	shuffle    - every take once in a random order, then again in a new order,
+//	             never saying the same take twice in a row
+var TakePolicies = []string{"roundrobin", "random", "shuffle"}
+
+// IsTakePolicy reports whether policy is one of TakePolicies
+func IsTakePolicy(policy string) bool {
+	for _, p := range TakePolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// takeDeck is the shuffled order of a prayer's takes still to be said
+type takeDeck struct {
+	order []int
+	last  int
+}
+
+// SetSeed restarts random and shuffled choices of takes from seed,
+// so that the same seed always chooses the same takes
+func (s *StateTracker) SetSeed(seed int64) {
+	s.Seed = seed
+	s.rand = nil
+	s.decks = nil
+}
+
+func (s *StateTracker) random() *rand.Rand {
+	if s.rand == nil {
+		s.rand = rand.New(rand.NewSource(s.Seed))
+	}
+	return s.rand
+}
+
+// TimesSaid returns how many times prayer has been said so far
+func (s *StateTracker) TimesSaid(prayer string) int {
+	return s.said[prayer]
+}
+
+// ChooseTake returns which of count takes of prayer to say, from 0, following policy.
+// An unknown or empty policy is treated as roundrobin.
+func (s *StateTracker) ChooseTake(prayer string, policy string, count int) int {
+	return s.chooseTake(prayer, prayer, policy, count)
+}
+
+// chooseTake is ChooseTake with the shuffled order kept under deck, so
+// that each file of a prayer can be shuffled on its own
+func (s *StateTracker) chooseTake(prayer string, deck string, policy string, count int) int {
+	if count <= 1 {
+		return 0
+	}
+	switch policy {
+	case "random":
+		return s.random().Intn(count)
+	case "shuffle":
+		if s.decks == nil {
+			s.decks = map[string]*takeDeck{}
+		}
+		// options of a prayer may have different numbers of takes
+		key := deck + "/" + strconv.Itoa(count)
+		d, ok := s.decks[key]
+		if !ok {
+			d = &takeDeck{last: -1}
+			s.decks[key] = d
+		}
+		if len(d.order) == 0 {
+			d.order = s.random().Perm(count)
+			if d.order[0] == d.last {
+				d.order[0], d.order[count-1] = d.order[count-1], d.order[0]
+			}
+		}
+		d.last, d.order = d.order[0], d.order[1:]
+		return d.last
+	default:
+		n := s.TimesSaid(prayer)
+		if prayer == "hailmary" {
+			n = s.HailMaryNum
+		}
+		if n < 1 {
+			return 0
+		}
+		return (n - 1) % count
+	}
+}
+
+// FindTakes returns the numbered takes of filename (filename_1, filename_2, etc)
+// found in InputDirs, in order of number. Where the same number is found in
+// more than one directory, the first directory searched wins, as in MatchActualFile.
+func (s *StateTracker) FindTakes(filename string) []string {
+	cacheKey := strings.Join(s.InputDirs, "\x00") + "\x00" + s.Format + "\x00" + filename
+	if takes, ok := s.foundTakes[cacheKey]; ok {
+		return takes
+	}
+	prefix := filepath.Base(filename) + "_"
+	ext := "." + s.Format
+	found := map[int]string{}
+	for _, p := range s.InputDirs {
+		dir := filepath.Join(p, filepath.Dir(filename))
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			name := e.Name()
+			if e.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+				continue
+			}
+			n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext))
+			if err != nil || n < 0 {
+				continue
+			}
+			if _, ok := found[n]; !ok {
+				found[n] = filepath.Join(dir, name)
+			}
+		}
+	}
+	nums := make([]int, 0, len(found))
+	for n := range found {
+		nums = append(nums, n)
+	}
+	sort.Ints(nums)
+	takes := make([]string, len(nums))
+	for i, n := range nums {
+		takes[i] = found[n]
+	}
+	if s.foundTakes == nil {
+		s.foundTakes = map[string][]string{}
+	}
+	s.foundTakes[cacheKey] = takes
+	return takes
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,146 @@
+package rosarygen
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+var stateTrackerType = reflect.TypeOf(&StateTracker{})
+
+// compileTemplate parses name and checks every field and method it uses
+// on the StateTracker, such as {{.Mystery}} or {{.Date.Year}}, so that
+// references to unknown fields are found before it is used
+func compileTemplate(name string) (*template.Template, error) {
+	t, err := template.New(".").Funcs(TemplateFuncs).Parse(name)
+	if err != nil {
+		return nil, err
+	}
+	c := &templateChecker{tree: t.Tree}
+	c.walk(t.Tree.Root, stateTrackerType)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return t, nil
+}
+
+// CheckTemplate parses name, reporting syntax errors and references
+// to unknown StateTracker fields
+func CheckTemplate(name string) error {
+	if !strings.Contains(name, "{{") {
+		return nil
+	}
+	_, err := compileTemplate(name)
+	return err
+}
+
+// templateChecker walks a parsed template, following the type of dot.
+// A nil type is a dot that cannot be known before executing, such as
+// inside {{range}} or {{with}}, and is not checked.
+type templateChecker struct {
+	tree *parse.Tree
+	err  error
+}
+
+func (c *templateChecker) walk(node parse.Node, dot reflect.Type) {
+	if c.err != nil || node == nil {
+		return
+	}
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, sub := range n.Nodes {
+			c.walk(sub, dot)
+		}
+	case *parse.ActionNode:
+		c.walk(n.Pipe, dot)
+	case *parse.IfNode:
+		c.branch(&n.BranchNode, dot, dot)
+	case *parse.RangeNode:
+		c.branch(&n.BranchNode, dot, nil)
+	case *parse.WithNode:
+		c.branch(&n.BranchNode, dot, nil)
+	case *parse.TemplateNode:
+		c.walk(n.Pipe, dot)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			c.walk(cmd, dot)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			c.walk(arg, dot)
+		}
+	case *parse.FieldNode:
+		c.fields(n, dot, n.Ident)
+	case *parse.VariableNode:
+		// $ is the StateTracker, whatever dot is; other variables are not followed
+		if n.Ident[0] == "$" {
+			c.fields(n, stateTrackerType, n.Ident[1:])
+		}
+	case *parse.ChainNode:
+		c.walk(n.Node, dot)
+	}
+}
+
+// branch walks an {{if}}, {{range}} or {{with}}, whose list is said with
+// dot as inner and whose {{else}} keeps dot
+func (c *templateChecker) branch(n *parse.BranchNode, dot reflect.Type, inner reflect.Type) {
+	c.walk(n.Pipe, dot)
+	c.walk(n.List, inner)
+	c.walk(n.ElseList, dot)
+}
+
+// fields checks that each of idents can be evaluated in turn from typ
+func (c *templateChecker) fields(node parse.Node, typ reflect.Type, idents []string) {
+	for _, ident := range idents {
+		if typ == nil {
+			return
+		}
+		next, ok := fieldType(typ, ident)
+		if !ok {
+			location, context := c.tree.ErrorContext(node)
+			c.err = fmt.Errorf("template: %v: executing %q at <%v>: can't evaluate field %v in type %v", location, c.tree.Name, context, ident, typ)
+			return
+		}
+		typ = next
+	}
+}
+
+// fieldType returns the type given by the field or method ident of typ,
+// nil if that cannot be known, and false if typ has no such field or method
+func fieldType(typ reflect.Type, ident string) (reflect.Type, bool) {
+	method, ok := typ.MethodByName(ident)
+	if !ok && typ.Kind() != reflect.Ptr && typ.Kind() != reflect.Interface {
+		method, ok = reflect.PtrTo(typ).MethodByName(ident)
+	}
+	if ok {
+		if method.Type.NumOut() == 0 {
+			return nil, true
+		}
+		return method.Type.Out(0), true
+	}
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Struct:
+		field, ok := typ.FieldByName(ident)
+		if !ok || !field.IsExported() {
+			return nil, false
+		}
+		return field.Type, true
+	case reflect.Map:
+		return typ.Elem(), true
+	case reflect.Interface:
+		return nil, true
+	default:
+		return nil, false
+	}
+}
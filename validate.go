@@ -0,0 +1,222 @@
+package rosarygen
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Validate cross-checks the loaded configuration and returns every problem found:
+// structures naming unknown prayers, groups naming unknown mysteries,
+// group sets and weekdays naming unknown groups, mysteries with fewer
+// verses than the Hail Marys a structure reads verses before,
+// options choosing an option a prayer does not have,
+// translations into unknown languages, and prayer filename, structure
+// condition and language templates using unknown StateTracker fields.
+func (g *Generator) Validate() []error {
+	var errs ErrorList
+
+	for _, k := range sortedKeys(g.Structures) {
+		reported := map[string]bool{} // a bad condition is usually repeated, report it once
+		g.Structures[k].Walk(func(section *Section) {
+			for _, e := range section.Entries {
+				if _, ok := g.Prayers[e.Prayer]; !ok {
+					errs.Add(fmt.Errorf("structure '%v' %v: unknown prayer '%v'", k, section.Key, e.Prayer))
+				}
+				for _, when := range e.When {
+					if err := CheckTemplate(when); err != nil && !reported[when] {
+						reported[when] = true
+						errs.Add(fmt.Errorf("structure '%v' %v: condition for '%v': %v", k, section.Key, e.Prayer, err))
+					}
+				}
+			}
+		})
+	}
+
+	for _, k := range sortedKeys(g.Structures) {
+		seasonal := g.Structures[k].Seasonal
+		for _, season := range sortedKeys(seasonal) {
+			for _, p := range sortedKeys(seasonal[season]) {
+				for _, e := range seasonal[season][p] {
+					if _, ok := g.Prayers[e.Prayer]; !ok {
+						errs.Add(fmt.Errorf("structure '%v' seasonal %v %v: unknown prayer '%v'", k, season, p, e.Prayer))
+					}
+					for _, when := range e.When {
+						if err := CheckTemplate(when); err != nil {
+							errs.Add(fmt.Errorf("structure '%v' seasonal %v %v: condition for '%v': %v", k, season, p, e.Prayer, err))
+						}
+					}
+				}
+			}
+		}
+	}
+
+	for _, k := range sortedKeys(g.Groups) {
+		for _, m := range g.Groups[k].Mysteries {
+			if _, ok := g.Mysteries[strconv.Itoa(m)]; !ok {
+				errs.Add(fmt.Errorf("group '%v': unknown mystery %v", k, m))
+			}
+		}
+	}
+
+	for _, k := range sortedKeys(g.GroupSets) {
+		for _, gk := range g.GroupSets[k].Groups {
+			if _, ok := g.Groups[gk]; !ok {
+				errs.Add(fmt.Errorf("groupset '%v': unknown group '%v'", k, gk))
+			}
+		}
+	}
+
+	nums := make([]int, 0, len(g.Mysteries))
+	for _, m := range g.Mysteries {
+		// mystery 0 stands in for the preamble and postamble
+		if m.Num != 0 {
+			nums = append(nums, m.Num)
+		}
+	}
+	sort.Ints(nums)
+	for _, k := range sortedKeys(g.Structures) {
+		need := versesNeeded(g.Structures[k])
+		if need == 0 {
+			continue
+		}
+		for _, n := range nums {
+			m := g.Mysteries[strconv.Itoa(n)]
+			if len(m.Verses) < need {
+				errs.Add(fmt.Errorf("mystery %v '%v' has %v verses, but structure '%v' says %v with %v Hail Marys", n, m.Name, len(m.Verses), k, VerseMeditation, need))
+			}
+		}
+	}
+
+	if g.Weekdays != nil {
+		validateWeekdays := func(where string, days map[string]string) {
+			for _, d := range sortedKeys(days) {
+				groups, err := g.GroupsForRosary(days[d], "")
+				if err != nil {
+					errs.Add(fmt.Errorf("%v %v: %v", where, d, err))
+					continue
+				}
+				for _, k := range groups {
+					if _, ok := g.Groups[k]; !ok {
+						errs.Add(fmt.Errorf("%v %v: unknown group '%v'", where, d, k))
+					}
+				}
+			}
+		}
+		validateWeekdays("weekday", g.Weekdays.Days)
+		for _, season := range sortedKeys(g.Weekdays.Seasons) {
+			validateWeekdays("weekday "+season, g.Weekdays.Seasons[season])
+		}
+	}
+
+	if g.Options != nil {
+		g.validateOptions(&errs, "options", g.Options)
+	}
+	for _, k := range sortedKeys(g.Structures) {
+		g.validateOptions(&errs, "structure '"+k+"' options", g.Structures[k].Options)
+	}
+
+	for _, k := range sortedKeys(g.Prayers) {
+		validatePrayerTemplates(&errs, "prayer '"+k+"'", g.Prayers[k])
+		g.validatePrayerLang(&errs, "prayer '"+k+"'", g.Prayers[k])
+	}
+	for _, k := range sortedKeys(g.Mysteries) {
+		g.validateLang(&errs, "mystery "+k, g.Mysteries[k].Lang)
+	}
+	for _, k := range sortedKeys(g.Groups) {
+		g.validateLang(&errs, "group '"+k+"'", g.Groups[k].Lang)
+	}
+	for _, k := range sortedKeys(g.Languages) {
+		l := g.Languages[k]
+		for _, t := range []string{l.XthGroupMystery, l.XofGroup} {
+			if err := CheckTemplate(t); err != nil {
+				errs.Add(fmt.Errorf("language '%v': %v", k, err))
+			}
+		}
+	}
+
+	return errs
+}
+
+// versesNeeded returns the most Hail Marys of any section of s that also
+// says versemeditation, or 0 if none does
+func versesNeeded(s *Structure) int {
+	need := 0
+	s.Walk(func(section *Section) {
+		verses, hailmarys := false, 0
+		for _, e := range section.Entries {
+			switch e.Prayer {
+			case VerseMeditation:
+				verses = true
+			case "hailmary":
+				hailmarys++
+			}
+		}
+		if verses && hailmarys > need {
+			need = hailmarys
+		}
+	})
+	return need
+}
+
+func (g *Generator) validateOptions(errs *ErrorList, where string, o *Options) {
+	if o == nil {
+		return
+	}
+	for _, k := range o.Prayers() {
+		if _, ok := g.Prayers[k]; !ok {
+			errs.Add(fmt.Errorf("%v: unknown prayer '%v'", where, k))
+		}
+		for _, r := range o.Rules[k] {
+			if err := CheckTemplate(r.When); err != nil {
+				errs.Add(fmt.Errorf("%v: prayer '%v' rule: %v", where, k, err))
+			}
+		}
+	}
+	errs.Add(o.Check(where, g.Prayers))
+}
+
+func (g *Generator) validateLang(errs *ErrorList, where string, l Localized) {
+	for _, lang := range sortedKeys(l) {
+		if _, ok := g.Languages[lang]; !ok {
+			errs.Add(fmt.Errorf("%v: translation into unknown language '%v'", where, lang))
+		}
+	}
+}
+
+func (g *Generator) validatePrayerLang(errs *ErrorList, where string, p *Prayer) {
+	g.validateLang(errs, where, p.Lang)
+	for _, o := range p.Options {
+		g.validatePrayerLang(errs, fmt.Sprintf("%v option %v", where, o.optionName()), o)
+	}
+}
+
+func validatePrayerTemplates(errs *ErrorList, where string, p *Prayer) {
+	if err := CheckTemplate(p.Filename); err != nil {
+		errs.Add(fmt.Errorf("%v filename: %v", where, err))
+	}
+	for _, f := range p.Filenames {
+		if err := CheckTemplate(f); err != nil {
+			errs.Add(fmt.Errorf("%v filenames: %v", where, err))
+		}
+	}
+	for i, take := range p.Takes {
+		for _, f := range take {
+			if err := CheckTemplate(f); err != nil {
+				errs.Add(fmt.Errorf("%v take %v: %v", where, i+1, err))
+			}
+		}
+	}
+	for _, o := range p.Options {
+		validatePrayerTemplates(errs, fmt.Sprintf("%v option %v", where, o.optionName()), o)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}